@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/google/logger"
+	"github.com/spf13/cobra"
+
+	"github.com/jamf/groupsync/services"
+)
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+}
+
+var applyCmd = &cobra.Command{
+	Use:   "apply <plan-file>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Commit the changes recorded in a plan file",
+	Long: `Commit the changes recorded in a plan file.
+
+Nothing is committed if the membership of any target group has changed since
+the plan was made.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		plan, err := readPlan(args[0])
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		for _, mp := range plan.Mappings {
+			fmt.Println(mp.String())
+		}
+
+		results, err := plan.Apply()
+
+		failed := 0
+		for i, result := range results {
+			if result.Failed() > 0 {
+				fmt.Printf("%s:\n%s", plan.Mappings[i].Target, result)
+				failed += result.Failed()
+			}
+		}
+
+		// Some of the mappings may have been committed before the error.
+		if err != nil && len(results) > 0 {
+			printApplySummary(os.Stdout, plan, results, err)
+		}
+
+		if err != nil {
+			services.CloseServices()
+			logger.Fatalf("Cannot apply plan! Cause: %s\n", err)
+		}
+
+		if failed > 0 {
+			services.CloseServices()
+			logger.Fatalf("Plan applied, but %d change(s) failed.\n", failed)
+		}
+
+		fmt.Println("Plan applied.")
+	},
+}
+
+// printApplySummary prints a table with the changes committed to each target
+// group of the plan, with the mapping that failed marked as such.
+func printApplySummary(
+	out io.Writer,
+	plan services.Plan,
+	results []services.CommitResult,
+	err error,
+) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tADD\tREMOVE\tFAILED\tSTATUS")
+
+	for i, mp := range plan.Mappings {
+		status := "not applied"
+		failed := 0
+
+		if i < len(results) {
+			failed = results[i].Failed()
+
+			status = "committed"
+			if failed > 0 || (err != nil && i == len(results)-1) {
+				status = "failed"
+			}
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%d\t%d\t%s\n",
+			mp.Target,
+			len(mp.Add),
+			len(mp.Rem),
+			failed,
+			status,
+		)
+	}
+
+	w.Flush()
+}
+
+func readPlan(filename string) (services.Plan, error) {
+	var plan services.Plan
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return plan, err
+	}
+
+	err = json.Unmarshal(data, &plan)
+	return plan, err
+}
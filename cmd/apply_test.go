@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/jamf/groupsync/services"
+)
+
+func TestApplySummary(t *testing.T) {
+	plan := services.Plan{
+		Mappings: []services.MappingPlan{
+			{Target: "github:a", Add: make([]services.PlannedUser, 2)},
+			{Target: "github:platform", Rem: make([]services.PlannedUser, 1)},
+			{Target: "github:all", Add: make([]services.PlannedUser, 1)},
+		},
+	}
+
+	// The second mapping failed to commit, so the third wasn't applied.
+	results := []services.CommitResult{{}, {}}
+
+	var out bytes.Buffer
+	printApplySummary(&out, plan, results, fmt.Errorf("bad credentials"))
+
+	const expected = "" +
+		"TARGET           ADD  REMOVE  FAILED  STATUS\n" +
+		"github:a         2    0       0       committed\n" +
+		"github:platform  0    1       0       failed\n" +
+		"github:all       1    0       0       not applied\n"
+
+	if out.String() != expected {
+		panic(fmt.Sprintf("unexpected summary:\n%s", out.String()))
+	}
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/logger"
+	"github.com/spf13/cobra"
+
+	"github.com/jamf/groupsync/services"
+)
+
+// The exit codes of the check command.
+const (
+	checkInSync = 0
+	checkError  = 1
+	checkDrift  = 2
+)
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.Flags().StringVarP(
+		&MappingFile,
+		"mapping-file",
+		"m",
+		"",
+		"the file to use for sync mappings",
+	)
+	checkCmd.Flags().IntVarP(
+		&Parallelism,
+		"parallelism",
+		"p",
+		1,
+		"the number of mappings to check at once",
+	)
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check <source>... <target>",
+	Args:  cobra.MinimumNArgs(0),
+	Short: "Check whether the target groups are in sync",
+	Long: `Check whether the target groups are in sync, without committing any
+changes.
+
+Exits with 0 if all the target groups are in sync, 2 if any of them drifted
+from their sources, and 1 if any of the mappings couldn't be checked.
+
+Mappings are checked against the current members of the groups. A mapping
+reading the target group of a drifted mapping may report drift that a sync
+of both mappings would resolve, or miss drift that it would cause.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		mappings, err := parseMappings(MappingFile, args)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(checkError)
+		}
+
+		results := make([]checkResult, len(mappings))
+
+		services.RunMappings(
+			mappings,
+			Parallelism,
+			// Nothing is committed, so mappings can be checked even
+			// if the ones they depend on fail.
+			func(i int, mapping *services.Mapping) error {
+				results[i] = checkMapping(mapping)
+				return nil
+			},
+			func(
+				i int,
+				mapping *services.Mapping,
+				err services.DependencyFailedError,
+			) {
+				results[i] = checkMapping(mapping)
+			},
+		)
+
+		printCheckSummary(os.Stdout, results)
+
+		services.CloseServices()
+		os.Exit(checkExitCode(results))
+	},
+}
+
+// checkResult is the drift of a single mapping.
+type checkResult struct {
+	sources  []string
+	target   string
+	add      int
+	rem      int
+	warnings int
+	err      error
+}
+
+func (r checkResult) drifted() bool {
+	return r.add > 0 || r.rem > 0
+}
+
+func checkMapping(mapping *services.Mapping) checkResult {
+	diff, err := mapping.Diff()
+
+	// The report names the sources and target even without a diff.
+	report := mapping.Report()
+	result := checkResult{
+		sources: report.Sources,
+		target:  report.Target,
+		err:     err,
+	}
+
+	if err == nil {
+		result.add = len(diff.Add)
+		result.rem = len(diff.Rem)
+		result.warnings = len(diff.Warnings)
+	}
+
+	return result
+}
+
+// printCheckSummary prints a line per mapping, followed by the totals.
+func printCheckSummary(out io.Writer, results []checkResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	drifted, failed := 0, 0
+
+	for _, r := range results {
+		var status, details string
+
+		switch {
+		case r.err != nil:
+			status = "ERROR"
+			details = r.err.Error()
+			failed++
+		case r.drifted():
+			status = "DRIFT"
+			details = fmt.Sprintf("+%d -%d", r.add, r.rem)
+			drifted++
+		default:
+			status = "OK"
+		}
+
+		if r.warnings > 0 {
+			details = strings.TrimSpace(
+				fmt.Sprintf("%s (%d warning(s))", details, r.warnings),
+			)
+		}
+
+		line := fmt.Sprintf(
+			"%s\t%s <- %s",
+			status,
+			r.target,
+			strings.Join(r.sources, ", "),
+		)
+		if details != "" {
+			line += "\t" + details
+		}
+
+		fmt.Fprintln(w, line)
+	}
+
+	w.Flush()
+
+	fmt.Fprintf(
+		out,
+		"\n%d mapping(s) in sync, %d drifted, %d failed.\n",
+		len(results)-drifted-failed,
+		drifted,
+		failed,
+	)
+}
+
+// checkExitCode returns the exit code for the results. Errors take precedence
+// over drift, as a mapping that couldn't be checked may have drifted too.
+func checkExitCode(results []checkResult) int {
+	code := checkInSync
+
+	for _, r := range results {
+		if r.err != nil {
+			return checkError
+		}
+
+		if r.drifted() {
+			code = checkDrift
+		}
+	}
+
+	return code
+}
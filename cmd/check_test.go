@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCheckSummary(t *testing.T) {
+	inSync := checkResult{sources: []string{"ldap:a"}, target: "github:a"}
+	drifted := checkResult{
+		sources:  []string{"ldap:b", "ldap:c"},
+		target:   "github:b",
+		add:      3,
+		rem:      1,
+		warnings: 2,
+	}
+	failed := checkResult{
+		sources: []string{"ldap:d"},
+		target:  "github:d",
+		err:     errors.New("no such group"),
+	}
+
+	var cases = []struct {
+		results []checkResult
+		code    int
+	}{
+		{[]checkResult{inSync}, checkInSync},
+		{[]checkResult{inSync, drifted}, checkDrift},
+		{[]checkResult{failed, drifted}, checkError},
+		{[]checkResult{drifted, failed}, checkError},
+	}
+
+	for _, c := range cases {
+		if code := checkExitCode(c.results); code != c.code {
+			panic(fmt.Sprintf("expected exit code %d, got %d", c.code, code))
+		}
+	}
+
+	var out bytes.Buffer
+	printCheckSummary(&out, []checkResult{inSync, drifted, failed})
+
+	const expected = "" +
+		"OK     github:a <- ldap:a\n" +
+		"DRIFT  github:b <- ldap:b, ldap:c  +3 -1 (2 warning(s))\n" +
+		"ERROR  github:d <- ldap:d          no such group\n" +
+		"\n1 mapping(s) in sync, 1 drifted, 1 failed.\n"
+
+	if out.String() != expected {
+		panic(fmt.Sprintf("unexpected summary:\n%s", out.String()))
+	}
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/google/logger"
 	"github.com/spf13/cobra"
@@ -11,6 +12,12 @@ import (
 
 func init() {
 	rootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().StringVar(
+		&Format,
+		"format",
+		formatTable,
+		"the output format: table, json or yaml",
+	)
 }
 
 var lsCmd = &cobra.Command{
@@ -19,13 +26,28 @@ var lsCmd = &cobra.Command{
 	Short: "List the members of a group (or groups)",
 	Long:  `List the members of a group (or groups).`,
 	Run: func(cmd *cobra.Command, args []string) {
+		err := checkFormat()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
 		svc, err := services.SvcFromString(args[0])
 		if err != nil {
 			logger.Fatal(err)
 		}
 
+		report := services.GroupsReport{Version: services.ReportVersion}
+		failed := false
+
 		for i, grp := range args[1:] {
 			members, err := svc.GroupMembers(grp)
+			if err != nil && structuredOutput() {
+				groupReport := services.NewGroupReport(args[0], grp, nil)
+				groupReport.Error = err.Error()
+				report.Groups = append(report.Groups, groupReport)
+				failed = true
+				continue
+			}
 			if err != nil {
 				msg := fmt.Sprintf(
 					"Error looking up members of group %s!\nError: %s\n",
@@ -43,6 +65,14 @@ var lsCmd = &cobra.Command{
 				continue
 			}
 
+			if structuredOutput() {
+				report.Groups = append(
+					report.Groups,
+					services.NewGroupReport(args[0], grp, members),
+				)
+				continue
+			}
+
 			fmt.Printf("- Group `%s`\n", grp)
 			for _, m := range members {
 				fmt.Println(m)
@@ -51,5 +81,17 @@ var lsCmd = &cobra.Command{
 				fmt.Println("")
 			}
 		}
+
+		if structuredOutput() {
+			err = printReport(report)
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			// Like in the table output, fail if the only group failed.
+			if failed && len(args[1:]) == 1 {
+				os.Exit(1)
+			}
+		}
 	},
 }
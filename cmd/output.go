@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats accepted by --format.
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+var Format string
+
+// checkFormat makes sure a known format was given with --format.
+func checkFormat() error {
+	switch Format {
+	case formatTable, formatJSON, formatYAML:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unknown output format `%s` (expected %s, %s or %s)",
+			Format,
+			formatTable,
+			formatJSON,
+			formatYAML,
+		)
+	}
+}
+
+// structuredOutput tells whether a report should be printed instead of the
+// human-friendly output.
+func structuredOutput() bool {
+	return Format == formatJSON || Format == formatYAML
+}
+
+// printReport prints `report` to stdout in the format given with --format.
+func printReport(report interface{}) error {
+	switch Format {
+	case formatJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case formatYAML:
+		enc := yaml.NewEncoder(os.Stdout)
+		defer enc.Close()
+		return enc.Encode(report)
+	default:
+		return fmt.Errorf("no report for output format `%s`", Format)
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/logger"
+	"github.com/spf13/cobra"
+
+	"github.com/jamf/groupsync/services"
+)
+
+var PlanFile string
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+	planCmd.Flags().StringVarP(
+		&MappingFile,
+		"mapping-file",
+		"m",
+		"",
+		"the file to use for sync mappings",
+	)
+	planCmd.Flags().StringVarP(
+		&PlanFile,
+		"out",
+		"o",
+		"",
+		"the file to write the plan to",
+	)
+	planCmd.MarkFlagRequired("out")
+	planCmd.Flags().BoolVarP(
+		&Force,
+		"force",
+		"f",
+		false,
+		"plan changes even if they go over the safety limits",
+	)
+	planCmd.Flags().IntVar(
+		&MaxRemovals,
+		"max-removals",
+		-1,
+		"the default limit of removals per mapping (-1 for no limit)",
+	)
+	planCmd.Flags().Float64Var(
+		&MaxRemovalPercent,
+		"max-removal-percent",
+		-1,
+		"the default limit of removals per mapping, as a percentage of "+
+			"the target group's size (-1 for no limit)",
+	)
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan -o <plan-file> <source>... <target>",
+	Args:  cobra.MinimumNArgs(0),
+	Short: "Record the changes sync would make in a plan file",
+	Long: `Record the changes sync would make in a plan file.
+
+The plan can be reviewed and later committed with the apply command.
+Mappings going over their safety limits are left out of the plan, unless
+--force is given.
+
+Changes are planned against the current members of the target groups. If a
+mapping reads the target group of another mapping, its changes don't account
+for the changes planned for that group.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		mappings, err := parseMappings(MappingFile, args)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		planned, skipped := withinLimits(mappings, globalLimits())
+
+		plan, err := services.NewPlan(planned)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		for _, mp := range plan.Mappings {
+			fmt.Println(mp.String())
+		}
+
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(PlanFile, data, 0644)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		fmt.Printf("Plan written to %s.\n", PlanFile)
+
+		if skipped > 0 {
+			logger.Errorf(
+				"%d mapping(s) left out of the plan for going over the "+
+					"safety limits. Use --force to plan them anyway.\n",
+				skipped,
+			)
+			services.CloseServices()
+			os.Exit(1)
+		}
+	},
+}
+
+// withinLimits returns the mappings that don't go over the safety limits (or
+// all of them, with --force), and how many were left out.
+func withinLimits(
+	mappings []services.Mapping,
+	limits services.Limits,
+) ([]services.Mapping, int) {
+	var result []services.Mapping
+	skipped := 0
+
+	for i := range mappings {
+		err := mappings[i].CheckLimits(limits)
+		if err != nil {
+			if _, ok := err.(services.LimitExceededError); !ok {
+				logger.Fatal(err)
+			}
+
+			if !Force {
+				fmt.Println(mappings[i].String())
+				logger.Errorf("Skipping mapping! Cause: %s\n", err)
+				skipped++
+				continue
+			}
+
+			fmt.Printf("Ignoring %s (--force given)\n", err)
+		}
+
+		result = append(result, mappings[i])
+	}
+
+	return result, skipped
+}
@@ -6,6 +6,7 @@ package cmd
 import (
 	"os"
 
+	"github.com/jamf/groupsync/services"
 	"github.com/spf13/cobra"
 )
 
@@ -23,7 +24,10 @@ var rootCmd = &cobra.Command{
 // Execute runs the root CLI command handler, backed by Cobra.
 // It parses parameters, flags, etc. and calls subcommands where appropriate.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	services.CloseServices()
+
+	if err != nil {
 		os.Exit(1)
 	}
 }
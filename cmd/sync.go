@@ -2,7 +2,12 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/google/logger"
 	"github.com/spf13/cobra"
@@ -13,6 +18,10 @@ import (
 
 var DryRun bool
 var MappingFile string
+var Force bool
+var MaxRemovals int
+var MaxRemovalPercent float64
+var Parallelism int
 
 func init() {
 	rootCmd.AddCommand(syncCmd)
@@ -30,6 +39,40 @@ func init() {
 		"",
 		"the file to use for sync mappings",
 	)
+	syncCmd.Flags().BoolVarP(
+		&Force,
+		"force",
+		"f",
+		false,
+		"commit changes even if they go over the safety limits",
+	)
+	syncCmd.Flags().IntVar(
+		&MaxRemovals,
+		"max-removals",
+		-1,
+		"the default limit of removals per mapping (-1 for no limit)",
+	)
+	syncCmd.Flags().Float64Var(
+		&MaxRemovalPercent,
+		"max-removal-percent",
+		-1,
+		"the default limit of removals per mapping, as a percentage of "+
+			"the target group's size (-1 for no limit)",
+	)
+	syncCmd.Flags().IntVarP(
+		&Parallelism,
+		"parallelism",
+		"p",
+		1,
+		"the number of mappings to sync at once; mappings that depend on "+
+			"each other are still synced in order",
+	)
+	syncCmd.Flags().StringVar(
+		&Format,
+		"format",
+		formatTable,
+		"the output format: table, json or yaml",
+	)
 }
 
 var syncCmd = &cobra.Command{
@@ -38,43 +81,296 @@ var syncCmd = &cobra.Command{
 	Short: "List the members of a group (or groups)",
 	Long:  `List the members of a group (or groups).`,
 	Run: func(cmd *cobra.Command, args []string) {
-		var mappings []services.Mapping
-		var err error
+		err := checkFormat()
+		if err != nil {
+			logger.Fatal(err)
+		}
 
-		if MappingFile != "" {
-			mappings, err = parseFileMappings(MappingFile)
-			if err != nil {
-				logger.Fatal(err)
+		mappings, err := parseMappings(MappingFile, args)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		report := services.SyncReport{Version: services.ReportVersion}
+		limits := globalLimits()
+		skipped := 0
+		warned := 0
+		failed := 0
+
+		results := make([]mappingResult, len(mappings))
+		finished := make([]chan struct{}, len(mappings))
+		for i := range finished {
+			finished[i] = make(chan struct{})
+		}
+
+		go services.RunMappings(
+			mappings,
+			Parallelism,
+			func(i int, mapping *services.Mapping) error {
+				results[i] = syncMapping(mapping, limits)
+				close(finished[i])
+
+				return results[i].err()
+			},
+			func(
+				i int,
+				mapping *services.Mapping,
+				err services.DependencyFailedError,
+			) {
+				results[i] = failedMapping(mapping)
+				results[i].depErr = err
+				results[i].report.Error = err.Error()
+				close(finished[i])
+			},
+		)
+
+		// Print the results in order, as soon as they're available.
+		for i := range results {
+			<-finished[i]
+			result := results[i]
+
+			if structuredOutput() {
+				report.Mappings = append(report.Mappings, result.report)
 			}
-		} else {
-			mapping, err := parseCLIMapping(args)
-			if err != nil {
-				logger.Fatal(err)
+
+			if result.diffErr != nil {
+				logger.Errorf("Cannot sync mapping! Cause: %s\n", result.diffErr)
+				failed++
+				continue
+			}
+
+			if result.depErr != nil {
+				logger.Errorf(
+					"Skipping mapping to %s! Cause: %s\n",
+					result.report.Target,
+					result.depErr,
+				)
+				failed++
+				continue
+			}
+
+			if result.warned {
+				warned++
+			}
+
+			if !structuredOutput() {
+				fmt.Print(result.output)
+			}
+
+			if result.skipErr != nil {
+				logger.Errorf("Skipping mapping! Cause: %s\n", result.skipErr)
+				skipped++
+				continue
 			}
 
-			mappings = append(mappings, mapping)
+			if result.commitErr != nil {
+				logger.Errorf(
+					"Cannot commit changes! Cause: %s\n",
+					result.commitErr,
+				)
+				failed++
+			}
 		}
 
-		for _, mapping := range mappings {
-			_, err := mapping.Diff()
+		if structuredOutput() {
+			err = printReport(report)
 			if err != nil {
 				logger.Fatal(err)
 			}
+		} else {
+			printSyncSummary(os.Stdout, results)
 
-			fmt.Println(mapping.String())
-
-			if DryRun {
-				fmt.Println("This is a dry run. No changes committed.")
-			} else {
-				err = mapping.CommitChanges()
-				if err != nil {
-					logger.Fatalf("Cannot commit changes! Cause: %s\n", err)
-				}
+			if warned > 0 {
+				fmt.Printf(
+					"%d mapping(s) had warnings - some users may be "+
+						"missing from the changes, see above.\n",
+					warned,
+				)
 			}
 		}
+
+		if skipped > 0 {
+			logger.Errorf(
+				"%d mapping(s) skipped for going over the safety limits. "+
+					"Use --force to commit them anyway.\n",
+				skipped,
+			)
+		}
+
+		if failed > 0 {
+			logger.Errorf(
+				"%d mapping(s) failed to sync some or all of their "+
+					"changes, see above.\n",
+				failed,
+			)
+		}
+
+		if skipped > 0 || failed > 0 {
+			services.CloseServices()
+			os.Exit(1)
+		}
 	},
 }
 
+// mappingResult is the outcome of syncing a single mapping. The output is
+// buffered, so that the output of mappings synced concurrently doesn't get
+// interleaved.
+type mappingResult struct {
+	output  string
+	report  services.MappingReport
+	warned  bool
+	diffErr error
+	// Why the mapping wasn't synced, if a mapping it depends on failed.
+	depErr error
+	// The safety limit the mapping went over, if it was skipped.
+	skipErr error
+	commit  services.CommitResult
+	// Why (some of) the changes couldn't be committed.
+	commitErr error
+}
+
+// syncMapping diffs the mapping and commits the changes, unless it's a dry
+// run or the changes go over the safety limits.
+func syncMapping(
+	mapping *services.Mapping,
+	limits services.Limits,
+) (result mappingResult) {
+	diff, err := mapping.Diff()
+	if err != nil {
+		result = failedMapping(mapping)
+		result.diffErr = err
+		result.report.Error = err.Error()
+		return result
+	}
+
+	result.warned = len(diff.Warnings) > 0
+	result.report = mapping.Report()
+
+	var out strings.Builder
+	defer func() { result.output = out.String() }()
+
+	fmt.Fprintln(&out, mapping.String())
+
+	err = mapping.CheckLimits(limits)
+	if err != nil {
+		if !Force {
+			result.skipErr = err
+			result.report.Status = services.MappingSkipped
+			result.report.Error = err.Error()
+			return result
+		}
+
+		fmt.Fprintf(&out, "Ignoring %s (--force given)\n", err)
+	}
+
+	if DryRun {
+		fmt.Fprintln(&out, "This is a dry run. No changes committed.")
+		result.report.Status = services.MappingDryRun
+		return result
+	}
+
+	result.commit, result.commitErr = mapping.CommitChanges()
+	if result.commitErr == nil {
+		result.commitErr = result.commit.Err()
+	}
+
+	result.report.SetCommitResult(result.commit)
+	fmt.Fprint(&out, result.commit.String())
+
+	if result.commitErr != nil {
+		result.report.Status = services.MappingFailed
+		result.report.Error = result.commitErr.Error()
+	} else {
+		result.report.Status = services.MappingCommitted
+	}
+
+	return result
+}
+
+// failedMapping is the result of a mapping that couldn't be synced at all.
+func failedMapping(mapping *services.Mapping) mappingResult {
+	var result mappingResult
+
+	result.report = mapping.Report()
+	result.report.Status = services.MappingFailed
+
+	return result
+}
+
+// err returns why the mapping failed, if it did. Mappings depending on a
+// failed mapping aren't synced, as its target may not be as expected. The same
+// goes for mappings skipped for going over the safety limits, as their
+// targets weren't updated.
+func (r mappingResult) err() error {
+	switch {
+	case r.diffErr != nil:
+		return r.diffErr
+	case r.depErr != nil:
+		return r.depErr
+	case r.skipErr != nil:
+		return r.skipErr
+	default:
+		return r.commitErr
+	}
+}
+
+// printSyncSummary prints a line per mapping with the number of changes and
+// how syncing it went.
+func printSyncSummary(out io.Writer, results []mappingResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tADD\tREMOVE\tFAILED\tSTATUS")
+
+	for _, r := range results {
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%d\t%d\t%s\n",
+			r.report.Target,
+			len(r.report.Add),
+			len(r.report.Remove),
+			r.commit.Failed(),
+			r.report.Status,
+		)
+	}
+
+	w.Flush()
+}
+
+// globalLimits returns the safety limits provided on the command line.
+func globalLimits() services.Limits {
+	var limits services.Limits
+
+	if MaxRemovals >= 0 {
+		limits.MaxRemovals = &MaxRemovals
+	}
+
+	if MaxRemovalPercent >= 0 {
+		limits.MaxRemovalPercent = &MaxRemovalPercent
+	}
+
+	return limits
+}
+
+// parseMappings reads the mappings from the mapping file if one is provided,
+// or from the command line arguments otherwise.
+func parseMappings(filename string, args []string) ([]services.Mapping, error) {
+	if filename != "" {
+		mappings, err := parseFileMappings(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sync groups before they're used as sources by other mappings.
+		return services.OrderMappings(mappings)
+	}
+
+	mapping, err := parseCLIMapping(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return []services.Mapping{mapping}, nil
+}
+
 func parseFileMappings(filename string) ([]services.Mapping, error) {
 	var mappings []services.Mapping
 
@@ -91,7 +387,12 @@ func parseFileMappings(filename string) ([]services.Mapping, error) {
 	}
 
 	for _, mapping := range mappingData {
-		mappings = append(mappings, mapping.IntoMapping())
+		expanded, err := mapping.IntoMappings()
+		if err != nil {
+			return nil, err
+		}
+
+		mappings = append(mappings, expanded...)
 	}
 
 	return mappings, nil
@@ -104,9 +405,9 @@ func parseCLIMapping(args []string) (services.Mapping, error) {
 		)
 	}
 
-	var sources []services.GroupIdent
+	var sources []services.SourceExpr
 	for _, srcString := range args[:len(args)-1] {
-		src, err := services.ParseGroupIdent(srcString)
+		src, err := parseCLISource(srcString)
 		if err != nil {
 			return services.Mapping{}, err
 		}
@@ -119,5 +420,21 @@ func parseCLIMapping(args []string) (services.Mapping, error) {
 		return services.Mapping{}, err
 	}
 
-	return services.NewMapping(sources, target), nil
+	return services.NewExprMapping(sources, target), nil
+}
+
+// sourceExprSyntax matches the parts of a source that make it a set
+// expression rather than a single group: operators preceded by whitespace,
+// parentheses and quotes.
+var sourceExprSyntax = regexp.MustCompile(`\s[&|-]|[()"]`)
+
+// parseCLISource parses a source given on the command line. Sources without
+// any expression syntax are taken as a single group, so that group names with
+// spaces (`ldap:Ship Crew`) don't need to be quoted.
+func parseCLISource(str string) (services.SourceExpr, error) {
+	if !sourceExprSyntax.MatchString(str) {
+		return services.ParseGroupIdent(str)
+	}
+
+	return services.ParseSourceExpr(str)
 }
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"reflect"
@@ -161,6 +162,45 @@ func TestParseCLIMapping(t *testing.T) {
 	if !ok {
 		panic("parsed mapping not as expected")
 	}
+
+	// Group names with spaces don't need to be quoted, unless they're part
+	// of a set expression.
+	mapping, err = parseCLIMapping([]string{
+		"ldap:Ship Crew",
+		"github:crew",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ok = reflect.DeepEqual(
+		mapping,
+		mappingConstructor(
+			[]string{
+				"ldap:Ship Crew",
+			},
+			"github:crew",
+		),
+	)
+
+	if !ok {
+		panic("parsed mapping with a space in a group name not as expected")
+	}
+
+	mapping, err = parseCLIMapping([]string{
+		`"ldap:Ship Crew" - ldap:interns`,
+		"github:crew",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if mapping.String() == mappingConstructor(
+		[]string{"ldap:Ship Crew"},
+		"github:crew",
+	).String() {
+		panic("set expression parsed as a single group")
+	}
 }
 
 func mappingConstructor(src []string, tar string) services.Mapping {
@@ -182,3 +222,67 @@ func mappingConstructor(src []string, tar string) services.Mapping {
 
 	return services.NewMapping(sources, t)
 }
+
+func TestSyncSkipsDependentsOfSkippedMappings(t *testing.T) {
+	var mappings []services.Mapping
+	for _, args := range [][]string{
+		{"ldap:platform", "github:platform"},
+		{"github:platform", "github:all-eng"},
+	} {
+		mapping, err := parseCLIMapping(args)
+		if err != nil {
+			panic(err)
+		}
+
+		mappings = append(mappings, mapping)
+	}
+
+	var skipped []int
+	services.RunMappings(
+		mappings,
+		1,
+		func(i int, mapping *services.Mapping) error {
+			var result mappingResult
+			if i == 0 {
+				// Went over the safety limits.
+				result.skipErr = fmt.Errorf("10 removals planned")
+			}
+
+			return result.err()
+		},
+		func(i int, mapping *services.Mapping, err services.DependencyFailedError) {
+			skipped = append(skipped, i)
+		},
+	)
+
+	if fmt.Sprint(skipped) != "[1]" {
+		panic(fmt.Sprintf("expected the dependent mapping to be skipped, got %v", skipped))
+	}
+}
+
+func TestSyncSummary(t *testing.T) {
+	var committed, failed mappingResult
+
+	committed.report.Target = "github:a"
+	committed.report.Add = make([]services.MemberReport, 2)
+	committed.report.Status = services.MappingCommitted
+
+	failed.report.Target = "github:platform"
+	failed.report.Remove = make([]services.MemberReport, 1)
+	failed.report.Status = services.MappingFailed
+	failed.commit.Removed = []services.ChangeResult{
+		{Err: fmt.Errorf("forbidden")},
+	}
+
+	var out bytes.Buffer
+	printSyncSummary(&out, []mappingResult{committed, failed})
+
+	const expected = "" +
+		"TARGET           ADD  REMOVE  FAILED  STATUS\n" +
+		"github:a         2    0       0       committed\n" +
+		"github:platform  0    1       1       failed\n"
+
+	if out.String() != expected {
+		panic(fmt.Sprintf("unexpected summary:\n%s", out.String()))
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/spf13/viper"
 )
@@ -9,10 +10,28 @@ import (
 type config struct {
 	LDAP   LDAPConfig
 	GitHub GitHubConfig
+	GitLab GitLabConfig
+	File   FileConfig
+
+	// Named service instances, see readServiceConfigs.
+	Services map[string]serviceConfig `mapstructure:"-"`
+}
+
+// serviceConfig is the config of a named service instance. Only the field
+// matching Type is filled in.
+type serviceConfig struct {
+	Type   string
+	LDAP   LDAPConfig
+	GitHub GitHubConfig
+	GitLab GitLabConfig
+	File   FileConfig
 }
 
 var cfg *config = nil
 
+// cfgMutex guards the initialization of cfg.
+var cfgMutex sync.Mutex
+
 func initConfig() error {
 	if cfg != nil {
 		return newConfigError(
@@ -23,6 +42,8 @@ func initConfig() error {
 	viper.SetConfigName("groupsync")
 	viper.SetDefault("LDAP", LDAPConfig{})
 	viper.SetDefault("GitHub", GitHubConfig{})
+	viper.SetDefault("GitLab", GitLabConfig{})
+	viper.SetDefault("File", FileConfig{})
 	viper.AddConfigPath("/etc/groupsync/")
 	viper.AddConfigPath("$HOME/.groupsync/")
 	viper.AddConfigPath(".")
@@ -37,11 +58,70 @@ func initConfig() error {
 		return newConfigError(err)
 	}
 
+	c.Services, err = readServiceConfigs(viper.GetViper())
+	if err != nil {
+		return newConfigError(err)
+	}
+
 	cfg = &c
 	return nil
 }
 
+// readServiceConfigs reads the named service instances from the `services`
+// section of the config, e.g.:
+//
+//	services:
+//	  corp-ldap:
+//	    type: ldap
+//	    server: ldap.my-org.com
+//	  oss-github:
+//	    type: github
+//	    org: my-oss-org
+//
+// The rest of the settings of an instance are the same as in the top-level
+// section for its type.
+func readServiceConfigs(v *viper.Viper) (map[string]serviceConfig, error) {
+	result := make(map[string]serviceConfig)
+
+	for name := range v.GetStringMap("services") {
+		sub := v.Sub("services." + name)
+		if sub == nil {
+			return nil, fmt.Errorf("service `%s` has no settings", name)
+		}
+
+		sc := serviceConfig{
+			Type: sub.GetString("type"),
+		}
+
+		var err error
+		switch sc.Type {
+		case "ldap":
+			err = sub.Unmarshal(&sc.LDAP)
+		case "github":
+			err = sub.Unmarshal(&sc.GitHub)
+		case "gitlab":
+			err = sub.Unmarshal(&sc.GitLab)
+		case "file":
+			err = sub.Unmarshal(&sc.File)
+		case "":
+			err = fmt.Errorf("no type given")
+		default:
+			err = fmt.Errorf("unknown type `%s`", sc.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("service `%s`: %v", name, err)
+		}
+
+		result[name] = sc
+	}
+
+	return result, nil
+}
+
 func getConfig() (config, error) {
+	cfgMutex.Lock()
+	defer cfgMutex.Unlock()
+
 	if cfg == nil {
 		err := initConfig()
 		if err != nil {
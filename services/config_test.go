@@ -0,0 +1,81 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+var namedServicesConfig = `
+ldap:
+  server: legacy-ldap.my-org.com
+
+services:
+  corp-ldap:
+    type: ldap
+    server: ldap.my-org.com
+    user_id_attribute: mail
+  oss-github:
+    type: github
+    org: foo
+  inner-github:
+    type: github
+    org: bar
+`
+
+func TestReadServiceConfigs(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(bytes.NewBufferString(namedServicesConfig))
+	if err != nil {
+		panic(err)
+	}
+
+	services, err := readServiceConfigs(v)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(services) != 3 {
+		panic(fmt.Sprintf("expected 3 services, got %+v", services))
+	}
+
+	if services["corp-ldap"].Type != "ldap" ||
+		services["corp-ldap"].LDAP.UserIDAttribute != "mail" {
+		panic(fmt.Sprintf("corp-ldap not parsed correctly: %+v", services["corp-ldap"]))
+	}
+
+	if services["oss-github"].GitHub.Org != "foo" ||
+		services["inner-github"].GitHub.Org != "bar" {
+		panic(fmt.Sprintf("github instances not parsed correctly: %+v", services))
+	}
+
+	svc, err := newSvcFromConfig("inner-github", services["inner-github"])
+	if err != nil {
+		panic(err)
+	}
+
+	if svc.(*GitHub).name != "inner-github" {
+		panic("service instance should be named after its config key")
+	}
+}
+
+func TestReadServiceConfigsUnknownType(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+services:
+  foo:
+    type: bar
+`))
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = readServiceConfigs(v)
+	if err == nil {
+		panic("readServiceConfigs() should fail for unknown service types")
+	}
+}
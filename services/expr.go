@@ -0,0 +1,307 @@
+package services
+
+// Set expressions over source groups, e.g.
+// `ldap:engineering & ldap:fulltime - ldap:on-leave`.
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SourceExpr is a mapping source - either a single group (GroupIdent) or a
+// set expression combining groups.
+type SourceExpr interface {
+	// evaluate returns the users matching the expression, keyed by the
+	// unique ID of their identity in the `tar` target service. Users whose
+	// target identity can't be acquired are left out with a warning.
+	evaluate(tar string) (map[string]User, []string, error)
+	// groups returns all the groups the expression is made of.
+	groups() []GroupIdent
+	String() string
+}
+
+// setExpr applies a set operation to the users of two expressions.
+type setExpr struct {
+	op    byte
+	left  SourceExpr
+	right SourceExpr
+}
+
+// Set operators. `&` takes precedence over `|` and `-`, which are evaluated
+// from left to right.
+const (
+	opIntersection = '&'
+	opUnion        = '|'
+	opDifference   = '-'
+)
+
+func (e setExpr) evaluate(tar string) (map[string]User, []string, error) {
+	left, warnings, err := e.left.evaluate(tar)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	right, rightWarnings, err := e.right.evaluate(tar)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings = append(warnings, rightWarnings...)
+
+	result := make(map[string]User)
+
+	switch e.op {
+	case opUnion:
+		for id, u := range left {
+			result[id] = u
+		}
+		for id, u := range right {
+			result[id] = u
+		}
+	case opIntersection:
+		for id, u := range left {
+			if _, ok := right[id]; ok {
+				result[id] = u
+			}
+		}
+	case opDifference:
+		for id, u := range left {
+			if _, ok := right[id]; !ok {
+				result[id] = u
+			}
+		}
+	default:
+		panic(fmt.Sprintf("unknown set operator `%c`", e.op))
+	}
+
+	return result, warnings, nil
+}
+
+func (e setExpr) groups() []GroupIdent {
+	return append(e.left.groups(), e.right.groups()...)
+}
+
+func (e setExpr) String() string {
+	return fmt.Sprintf(
+		"%s %c %s",
+		exprOperandString(e.left),
+		e.op,
+		exprOperandString(e.right),
+	)
+}
+
+// exprOperandString formats an operand of a set expression, wrapping nested
+// set expressions in parentheses.
+func exprOperandString(e SourceExpr) string {
+	if _, ok := e.(setExpr); ok {
+		return "(" + e.String() + ")"
+	}
+
+	return e.String()
+}
+
+func (i GroupIdent) groups() []GroupIdent {
+	return []GroupIdent{i}
+}
+
+func (i GroupIdent) evaluate(tar string) (map[string]User, []string, error) {
+	members, err := i.Members()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make(map[string]User)
+	var warnings []string
+
+	for _, u := range members {
+		id, err := u.getIdentity(tar)
+		if err != nil {
+			switch err.(type) {
+			case FatalError:
+				return nil, nil, err
+			default:
+				warnings = append(warnings, fmt.Sprintf(
+					"couldn't acquire %s identity for %v(from %s) - "+
+						"skipping: %v",
+					tar,
+					u,
+					i,
+					err,
+				))
+				continue
+			}
+		}
+
+		if IdentityExists(id) {
+			result[id.uniqueID()] = u
+		}
+	}
+
+	return result, warnings, nil
+}
+
+// ParseSourceExpr parses a mapping source. Groups (`service:group`) can be
+// combined with the `&` (intersection), `|` (union) and `-` (difference)
+// operators and grouped with parentheses. Operators have to be preceded by
+// whitespace, so that they can be part of group names, e.g.
+// `ldap:engineering & ldap:full-time - ldap:on-leave`. Groups with spaces
+// in their names can be quoted: `"ldap:Ship Crew"`.
+func ParseSourceExpr(str string) (SourceExpr, error) {
+	p := exprParser{str: str}
+
+	expr, err := p.parseUnion()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if !p.done() {
+		return nil, p.errorf("unexpected `%s`", p.str[p.pos:])
+	}
+
+	return expr, nil
+}
+
+type exprParser struct {
+	str string
+	pos int
+}
+
+func (p *exprParser) done() bool {
+	return p.pos >= len(p.str)
+}
+
+func (p *exprParser) peek() byte {
+	return p.str[p.pos]
+}
+
+func (p *exprParser) skipSpace() {
+	for !p.done() && unicode.IsSpace(rune(p.peek())) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(
+		"invalid source expression `%s` at position %d: %s",
+		p.str,
+		p.pos,
+		fmt.Sprintf(format, args...),
+	)
+}
+
+// parseUnion parses operands joined by the lowest precedence operators.
+func (p *exprParser) parseUnion() (SourceExpr, error) {
+	left, err := p.parseIntersection()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpace()
+		if p.done() || (p.peek() != opUnion && p.peek() != opDifference) {
+			return left, nil
+		}
+
+		op := p.peek()
+		p.pos++
+
+		right, err := p.parseIntersection()
+		if err != nil {
+			return nil, err
+		}
+
+		left = setExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseIntersection() (SourceExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpace()
+		if p.done() || p.peek() != opIntersection {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		left = setExpr{op: opIntersection, left: left, right: right}
+	}
+}
+
+// parseOperand parses a parenthesized expression or a single group.
+func (p *exprParser) parseOperand() (SourceExpr, error) {
+	p.skipSpace()
+	if p.done() {
+		return nil, p.errorf("expected a group")
+	}
+
+	switch p.peek() {
+	case '(':
+		p.pos++
+
+		expr, err := p.parseUnion()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		if p.done() || p.peek() != ')' {
+			return nil, p.errorf("expected `)`")
+		}
+		p.pos++
+
+		return expr, nil
+	case '"':
+		p.pos++
+
+		end := strings.IndexByte(p.str[p.pos:], '"')
+		if end < 0 {
+			return nil, p.errorf("unterminated quote")
+		}
+
+		group := p.str[p.pos : p.pos+end]
+		p.pos += end + 1
+
+		return ParseGroupIdent(group)
+	case opIntersection, opUnion, opDifference, ')':
+		return nil, p.errorf("expected a group, got `%c`", p.peek())
+	}
+
+	// A group ends at whitespace or at the parenthesis closing a group of
+	// operands. Parentheses within the group must be balanced, and may
+	// contain whitespace.
+	start := p.pos
+	depth := 0
+
+	for !p.done() {
+		if depth == 0 && unicode.IsSpace(rune(p.peek())) {
+			break
+		}
+
+		if p.peek() == '(' {
+			depth++
+		} else if p.peek() == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+
+		p.pos++
+	}
+
+	if depth > 0 {
+		return nil, p.errorf("unbalanced `(` in group")
+	}
+
+	return ParseGroupIdent(p.str[start:p.pos])
+}
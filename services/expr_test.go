@@ -0,0 +1,88 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestParseSourceExpr(t *testing.T) {
+	var cases = []struct {
+		expr     string
+		expected string
+	}{
+		{"ldap:eng", "ldap:eng"},
+		{"ldap:eng & ldap:full-time - ldap:on-leave", "(ldap:eng & ldap:full-time) - ldap:on-leave"},
+		{"ldap:a | ldap:b & ldap:c", "ldap:a | (ldap:b & ldap:c)"},
+		{"ldap:a - (ldap:b | ldap:c)", "ldap:a - (ldap:b | ldap:c)"},
+		{"(ldap:a)-ldap:b", "ldap:a - ldap:b"},
+		{`"ldap:Ship Crew" & github:R&D`, "ldap:Ship Crew & github:R&D"},
+		{"ldap-filter:(&(a=b)(c=d e)) - ldap:x", "ldap-filter:(&(a=b)(c=d e)) - ldap:x"},
+	}
+
+	for _, c := range cases {
+		expr, err := ParseSourceExpr(c.expr)
+		if err != nil {
+			panic(err)
+		}
+
+		if expr.String() != c.expected {
+			panic(fmt.Sprintf(
+				"`%s` parsed as `%s`, expected `%s`",
+				c.expr,
+				expr,
+				c.expected,
+			))
+		}
+	}
+
+	for _, invalid := range []string{
+		"",
+		"ldap:a &",
+		"(ldap:a | ldap:b",
+		"ldap:a ldap:b",
+		`"ldap:a`,
+		"ldap-filter:(a=b",
+		"nope",
+	} {
+		_, err := ParseSourceExpr(invalid)
+		if err == nil {
+			panic(fmt.Sprintf("`%s` should be invalid", invalid))
+		}
+	}
+}
+
+func TestMappingSourceExpr(t *testing.T) {
+	mockGroups["expr-eng"] = buildMockUsers(0, 6)
+	mockGroups["expr-contractors"] = buildMockUsers(4, 8)
+	mockGroups["expr-on-leave"] = buildMockUsers(0, 1)
+	mockGroups["expr-tar"] = buildMockUsers(0, 0)
+
+	expr, err := ParseSourceExpr(
+		"mockservice:expr-eng - mockservice:expr-contractors - " +
+			"mockservice:expr-on-leave",
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	mapping := NewExprMapping(
+		[]SourceExpr{expr},
+		GroupIdent{svc: "mockservice", name: "expr-tar"},
+	)
+
+	diff, err := mapping.Diff()
+	if err != nil {
+		panic(err)
+	}
+
+	var added []string
+	for _, u := range diff.Add {
+		added = append(added, u.identities["mockservice"].uniqueID())
+	}
+	sort.Strings(added)
+
+	if fmt.Sprint(added) != "[1 2 3]" {
+		panic(fmt.Sprintf("expected users 1-3 to be added, got %v", added))
+	}
+}
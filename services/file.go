@@ -0,0 +1,357 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File reads group definitions from local YAML or CSV files, for groups
+// managed outside of any directory (vendor lists, HR exports, etc.) that are
+// best kept under version control.
+type File struct {
+	name string
+	cfg  FileConfig
+}
+
+type FileConfig struct {
+	// Either a directory with a `<group>.yaml`, `<group>.yml` or
+	// `<group>.csv` file per group, or a single file defining all the groups.
+	//
+	// Group files list one member per entry (YAML) or per row (CSV, first
+	// column). A single YAML file maps group names to such lists, while a
+	// single CSV file has a `group,member` row per member. CSV files may start
+	// with a header row, recognized by its first column (e.g. `email` or
+	// `group`).
+	Path string
+
+	// The service members are identified by, e.g. `ldap` (the default) or
+	// `github`. Members can also be qualified with a service name, e.g.
+	// `github:jdoe`.
+	Identity string
+}
+
+// NewFile creates a new instance of File called `name` with the provided
+// configuration.
+func NewFile(name string, cfg FileConfig) *File {
+	return &File{
+		name: name,
+		cfg:  cfg,
+	}
+}
+
+// Implement Service for File.
+
+// GroupMembers returns the members of group `group` as defined in the
+// configured file(s).
+func (f *File) GroupMembers(group string) ([]User, error) {
+	refs, err := f.groupRefs(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []User
+	for _, ref := range refs {
+		user, err := f.memberFromRef(ref)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"cannot resolve `%s` from group `%s`: %v",
+				ref,
+				group,
+				err,
+			)
+		}
+
+		members = append(members, user)
+	}
+
+	return members, nil
+}
+
+// ListGroups returns the names of the groups defined in the configured
+// file(s). Implements the GroupLister interface.
+func (f *File) ListGroups() ([]string, error) {
+	info, err := os.Stat(f.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var groups []string
+
+	addGroup := func(group string) {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		files, err := ioutil.ReadDir(f.cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			ext := strings.ToLower(filepath.Ext(file.Name()))
+			if !file.IsDir() &&
+				(ext == ".yaml" || ext == ".yml" || ext == ".csv") {
+				addGroup(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())))
+			}
+		}
+	case isCSV(f.cfg.Path):
+		rows, err := readCSV(f.cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			addGroup(strings.TrimSpace(row[0]))
+		}
+	default:
+		data, err := ioutil.ReadFile(f.cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var defs map[string][]string
+		err = yaml.Unmarshal(data, &defs)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %v", f.cfg.Path, err)
+		}
+
+		for group := range defs {
+			addGroup(group)
+		}
+	}
+
+	return groups, nil
+}
+
+// memberFromRef returns the member referenced by `ref`. Members qualified with
+// a service name (e.g. `github:jdoe`) are looked up in that service. The rest
+// are given an identity in the configured identity service as they are, unless
+// the service needs to look users up to identify them (e.g. GitHub).
+func (f *File) memberFromRef(ref string) (User, error) {
+	svc := f.identityService()
+	if strings.Contains(ref, ":") {
+		return userFromRef(ref, svc)
+	}
+
+	s, err := SvcFromString(svc)
+	if err != nil {
+		return userFromRef(ref, svc)
+	}
+
+	builder, ok := s.(identityBuilder)
+	if !ok {
+		return userFromRef(ref, svc)
+	}
+
+	user := newUser()
+	user.addIdentity(svc, builder.identityFor(ref))
+
+	return user, nil
+}
+
+func (f *File) identityService() string {
+	if f.cfg.Identity == "" {
+		return "ldap"
+	}
+
+	return f.cfg.Identity
+}
+
+// groupRefs returns the references to the members of `group`.
+func (f *File) groupRefs(group string) ([]string, error) {
+	if f.cfg.Path == "" {
+		return nil, fmt.Errorf("no path configured for `%s`", f.name)
+	}
+
+	info, err := os.Stat(f.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return f.groupRefsFromDir(group)
+	}
+
+	if isCSV(f.cfg.Path) {
+		return groupRefsFromCSV(f.cfg.Path, group)
+	}
+
+	return groupRefsFromYAML(f.cfg.Path, group)
+}
+
+func (f *File) groupRefsFromDir(group string) ([]string, error) {
+	// Don't let group names escape the directory.
+	if strings.ContainsAny(group, `/\`) || group == ".." {
+		return nil, fmt.Errorf("invalid group name `%s`", group)
+	}
+
+	for _, ext := range []string{".yaml", ".yml", ".csv"} {
+		path := filepath.Join(f.cfg.Path, group+ext)
+
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if isCSV(path) {
+			return readRefsCSV(path)
+		}
+
+		return readRefsYAML(path)
+	}
+
+	return nil, fmt.Errorf(
+		"group `%s` not defined in %s",
+		group,
+		f.cfg.Path,
+	)
+}
+
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// readRefsYAML reads a YAML list of members.
+func readRefsYAML(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	err = yaml.Unmarshal(data, &refs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+
+	return refs, nil
+}
+
+// readRefsCSV reads the first column of a CSV file.
+func readRefsCSV(path string) ([]string, error) {
+	rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, row := range rows {
+		if ref := strings.TrimSpace(row[0]); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs, nil
+}
+
+// groupRefsFromYAML reads the members of `group` from a YAML map of groups.
+func groupRefsFromYAML(path, group string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups map[string][]string
+	err = yaml.Unmarshal(data, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+
+	refs, ok := groups[group]
+	if !ok {
+		return nil, fmt.Errorf("group `%s` not defined in %s", group, path)
+	}
+
+	return refs, nil
+}
+
+// groupRefsFromCSV reads the members of `group` from `group,member` rows.
+func groupRefsFromCSV(path, group string) ([]string, error) {
+	rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	var refs []string
+
+	for _, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf(
+				"expected `group,member` rows in %s, got `%s`",
+				path,
+				strings.Join(row, ","),
+			)
+		}
+
+		if strings.TrimSpace(row[0]) != group {
+			continue
+		}
+
+		found = true
+		if ref := strings.TrimSpace(row[1]); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("group `%s` not defined in %s", group, path)
+	}
+
+	return refs, nil
+}
+
+func readCSV(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+
+	// Exports often start with a header row, which mustn't become a member.
+	if len(rows) > 0 {
+		first := strings.ToLower(strings.TrimSpace(rows[0][0]))
+		if csvHeaders[first] {
+			rows = rows[1:]
+		}
+	}
+
+	return rows, nil
+}
+
+// csvHeaders are the names of the first column that mark the first row of a
+// CSV file as a header, e.g. `email,name` or `group,member`.
+var csvHeaders = map[string]bool{
+	"group":    true,
+	"member":   true,
+	"user":     true,
+	"uid":      true,
+	"id":       true,
+	"login":    true,
+	"username": true,
+	"email":    true,
+	"mail":     true,
+	"name":     true,
+}
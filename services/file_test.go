@@ -0,0 +1,100 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestFileGroupMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groupsync-file-*")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(dir, "vendors.yaml", "- alice\n- bob\n")
+	writeTestFile(dir, "contractors.csv", "# HR export\ncarol,Carol C.\ndave,Dave D.\n")
+	writeTestFile(dir, "all.yaml", "vendors: [alice, bob]\ncontractors: [carol]\n")
+	writeTestFile(dir, "all.csv", "vendors,alice\ncontractors,carol\ncontractors,dave\n")
+	writeTestFile(dir, "export.csv", "Email,Login\nerin@my-org.com,erin\n")
+	writeTestFile(dir, "groups.csv", "group,member\nvendors,alice\n")
+
+	var cases = []struct {
+		path    string
+		group   string
+		members []string
+	}{
+		{dir, "vendors", []string{"alice", "bob"}},
+		{dir, "contractors", []string{"carol", "dave"}},
+		{filepath.Join(dir, "all.yaml"), "vendors", []string{"alice", "bob"}},
+		{filepath.Join(dir, "all.csv"), "contractors", []string{"carol", "dave"}},
+		// Header rows aren't members.
+		{dir, "export", []string{"erin@my-org.com"}},
+		{filepath.Join(dir, "groups.csv"), "vendors", []string{"alice"}},
+	}
+
+	for _, c := range cases {
+		f := NewFile("file", FileConfig{Path: c.path, Identity: "mockservice"})
+
+		members, err := f.GroupMembers(c.group)
+		if err != nil {
+			panic(err)
+		}
+
+		var ids []string
+		for _, m := range members {
+			ids = append(ids, m.identities["mockservice"].uniqueID())
+		}
+		sort.Strings(ids)
+
+		if fmt.Sprint(ids) != fmt.Sprint(c.members) {
+			panic(fmt.Sprintf(
+				"%s: expected members %v of %s, got %v",
+				c.path,
+				c.members,
+				c.group,
+				ids,
+			))
+		}
+	}
+
+	// Members are identified without looking them up, so that a stale entry
+	// doesn't fail the whole group. Only qualified members are looked up.
+	writeTestFile(dir, "mixed.yaml", "- gone\n- mockservice:alice\n")
+	f := NewFile("file", FileConfig{Path: dir, Identity: "test-ldap"})
+	saveSvcInCache("test-ldap", &LDAP{name: "test-ldap"})
+	defer delete(initializedServices, "test-ldap")
+
+	members, err := f.GroupMembers("mixed")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(members) != 2 ||
+		members[0].identities["test-ldap"] != (LDAPIdentity{id: "gone"}) ||
+		members[1].identities["mockservice"] != (MockIdentity{uid: "alice"}) {
+		panic(fmt.Sprintf("unexpected members of mixed: %v", members))
+	}
+
+	f = NewFile("file", FileConfig{Path: dir, Identity: "mockservice"})
+	_, err = f.GroupMembers("nope")
+	if err == nil {
+		panic("expected an error for an undefined group")
+	}
+
+	_, err = f.GroupMembers("../vendors")
+	if err == nil {
+		panic("expected an error for a group outside of the directory")
+	}
+}
+
+func writeTestFile(dir, name, content string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	if err != nil {
+		panic(err)
+	}
+}
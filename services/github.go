@@ -3,6 +3,9 @@ package services
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 
 	githubv3 "github.com/google/go-github/v28/github"
 	"github.com/google/logger"
@@ -11,17 +14,39 @@ import (
 )
 
 type GitHub struct {
+	name          string
 	v3client      *githubv3.Client
 	v4client      *githubv4.Client
 	mappingsCache map[string]GitHubSAMLMapping
 	cfg           GitHubConfig
+
+	// Guard the lazily initialized clients and mappingsCache, as the service
+	// is shared by mappings running concurrently.
+	clientMutex   sync.Mutex
+	mappingsMutex sync.Mutex
 }
 
 type GitHubConfig struct {
 	Token string
 	Org   string
+
+	// The URL of a GitHub Enterprise Server instance, e.g.
+	// https://github.my-org.com. Leave empty for github.com.
+	BaseURL string `mapstructure:"base_url"`
+
+	// Authentication as a GitHub App, used instead of Token if AppID is set.
+	// If InstallationID isn't set, the installation for Org is looked up.
+	AppID          int64  `mapstructure:"app_id"`
+	PrivateKeyPath string `mapstructure:"private_key_path"`
+	InstallationID int64  `mapstructure:"installation_id"`
+
+	// The number of team members fetched per GraphQL query.
+	PageSize int `mapstructure:"page_size"`
 }
 
+// The maximum page size the GitHub GraphQL API allows.
+const defaultGitHubPageSize = 100
+
 type GitHubIdentity struct {
 	ID    string
 	Login string
@@ -32,6 +57,10 @@ func (i GitHubIdentity) uniqueID() string {
 	return i.ID
 }
 
+func (i GitHubIdentity) userID() string {
+	return i.Login
+}
+
 func (i GitHubIdentity) String() string {
 	return fmt.Sprintf("github{uid: %s, login: %s}", i.ID, i.Login)
 }
@@ -50,16 +79,22 @@ type GitHubSAMLMapping struct {
 	} `graphql:"samlIdentity"`
 }
 
-func NewGitHub(cfg GitHubConfig) *GitHub {
+// NewGitHub creates a new instance of GitHub called `name` with the provided
+// configuration.
+func NewGitHub(name string, cfg GitHubConfig) *GitHub {
 	return &GitHub{
-		cfg: cfg,
+		name: name,
+		cfg:  cfg,
 	}
 }
 
 // Implement Service for GitHub.
 
-func (g GitHub) GroupMembers(group string) ([]User, error) {
-	g.initClient()
+func (g *GitHub) GroupMembers(group string) ([]User, error) {
+	err := g.initClient()
+	if err != nil {
+		return nil, err
+	}
 
 	var membersQuery struct {
 		Viewer struct {
@@ -70,45 +105,119 @@ func (g GitHub) GroupMembers(group string) ([]User, error) {
 						Edges []struct {
 							Node GitHubIdentity
 						}
-					}
+						PageInfo struct {
+							EndCursor   string
+							HasNextPage bool
+						}
+					} `graphql:"members(first: $page_size, after: $page_cursor)"`
 				} `graphql:"team(slug: $grp)"`
 			} `graphql:"organization(login: $org)"`
 		}
 	}
 
 	vars := map[string]interface{}{
-		"org": githubv4.String(g.cfg.Org),
-		"grp": githubv4.String(group),
+		"org":         githubv4.String(g.cfg.Org),
+		"grp":         githubv4.String(group),
+		"page_size":   githubv4.Int(g.pageSize()),
+		"page_cursor": (*githubv4.String)(nil),
 	}
 
-	err := g.v4client.Query(
-		context.Background(),
-		&membersQuery,
-		vars,
-	)
-	if err != nil {
-		return nil, err
+	var result []User
+
+	for {
+		err = g.v4client.Query(
+			context.Background(),
+			&membersQuery,
+			vars,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		team := membersQuery.Viewer.Organization.Team
+		if team.Name == "" {
+			return nil, fmt.Errorf("Cannot find GitHub team called \"%s\"", group)
+		}
+
+		for _, entry := range team.Members.Edges {
+			user := newUser()
+			user.addIdentity(g.name, entry.Node)
+			result = append(result, user)
+		}
+
+		if !team.Members.PageInfo.HasNextPage {
+			break
+		}
+
+		vars["page_cursor"] = githubv4.NewString(
+			githubv4.String(team.Members.PageInfo.EndCursor),
+		)
 	}
 
-	if membersQuery.Viewer.Organization.Team.Name == "" {
-		return nil, fmt.Errorf("Cannot find GitHub team called \"%s\"", group)
+	return result, nil
+}
+
+func (g *GitHub) pageSize() int {
+	if g.cfg.PageSize > 0 {
+		return g.cfg.PageSize
 	}
 
-	var result []User
+	return defaultGitHubPageSize
+}
 
-	for _, entry := range membersQuery.Viewer.Organization.Team.Members.Edges {
-		user := newUser()
-		user.addIdentity("github", entry.Node)
-		result = append(result, user)
+// ListGroups returns the slugs of all the teams of the org. Implements the
+// GroupLister interface.
+func (g *GitHub) ListGroups() ([]string, error) {
+	err := g.initClient()
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	var result []string
+
+	opt := &githubv3.ListOptions{PerPage: 100}
+	for {
+		teams, resp, err := g.v3client.Teams.ListTeams(
+			context.Background(),
+			g.cfg.Org,
+			opt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error listing the teams of `%s`: %v",
+				g.cfg.Org,
+				err,
+			)
+		}
+
+		for _, team := range teams {
+			result = append(result, team.GetSlug())
+		}
+
+		if resp.NextPage == 0 {
+			return result, nil
+		}
+		opt.Page = resp.NextPage
+	}
 }
 
 // Implement Target for GitHub.
 
 func (g *GitHub) acquireIdentity(user *User) (Identity, error) {
-	ldapIdentity, ok := user.identities["ldap"]
+	// Identities from other instances pointing to the same GitHub server are
+	// just as good.
+	ghIdentity, ok := user.findIdentity(func(svc string, i Identity) bool {
+		_, isGitHub := i.(GitHubIdentity)
+		return isGitHub && g.sameServer(svc)
+	})
+	if ok {
+		return ghIdentity, nil
+	}
+
+	ldapIdentity, ok := user.findIdentity(func(_ string, i Identity) bool {
+		_, isLDAP := i.(LDAPIdentity)
+		return isLDAP
+	})
 	if ok {
 		mappings, err := g.getAllGitHubMappings()
 		if err != nil {
@@ -132,14 +241,58 @@ func (g *GitHub) acquireIdentity(user *User) (Identity, error) {
 		}, nil
 	}
 
+	emailIdentity, ok := user.findIdentity(func(_ string, i Identity) bool {
+		_, isEmail := i.(EmailIdentity)
+		return isEmail
+	})
+	if ok {
+		mappings, err := g.getAllGitHubMappings()
+		if err != nil {
+			return nil, newFatalError(
+				"acquiring all SAML mappings",
+				err,
+			)
+		}
+
+		// SAML identities are often emails, but the email of the GitHub
+		// user will do too.
+		email := emailIdentity.userID()
+		for nameID, mapping := range mappings {
+			if strings.EqualFold(nameID, email) ||
+				strings.EqualFold(mapping.User.Email, email) {
+				return GitHubIdentity{
+					ID:    mapping.User.ID,
+					Login: mapping.User.Login,
+				}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("no github user found for `%s`", email)
+	}
+
 	return nil, fmt.Errorf(
 		"couldn't acquire github identity for user:\n%v",
 		user,
 	)
 }
 
+// sameServer checks whether the service `svc` is a GitHub instance talking to
+// the same server as this one.
+func (g *GitHub) sameServer(svc string) bool {
+	other, err := SvcFromString(svc)
+	if err != nil {
+		return false
+	}
+
+	otherGitHub, ok := other.(*GitHub)
+	return ok && otherGitHub.cfg.BaseURL == g.cfg.BaseURL
+}
+
 func (g *GitHub) identityFromUID(login string) (Identity, error) {
-	g.initClient()
+	err := g.initClient()
+	if err != nil {
+		return nil, err
+	}
 
 	var userQuery struct {
 		User GitHubIdentity `graphql:"user(login: $login)"`
@@ -149,7 +302,7 @@ func (g *GitHub) identityFromUID(login string) (Identity, error) {
 		"login": githubv4.String(login),
 	}
 
-	err := g.v4client.Query(
+	err = g.v4client.Query(
 		context.Background(),
 		&userQuery,
 		vars,
@@ -161,8 +314,11 @@ func (g *GitHub) identityFromUID(login string) (Identity, error) {
 	return userQuery.User, nil
 }
 
-func (g GitHub) AddMembers(teamSlug string, users []User) error {
-	g.initClient()
+func (g *GitHub) AddMembers(teamSlug string, users []User) ([]ChangeResult, error) {
+	err := g.initClient()
+	if err != nil {
+		return nil, err
+	}
 
 	team, _, err := g.v3client.Teams.GetTeamBySlug(
 		context.Background(),
@@ -170,17 +326,19 @@ func (g GitHub) AddMembers(teamSlug string, users []User) error {
 		teamSlug,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var results []ChangeResult
+
 	for _, user := range users {
-		identity, err := user.getIdentity("github")
+		identity, err := user.getIdentity(g.name)
 		if err != nil {
 			switch err.(type) {
 			case FatalError:
-				return err
+				return results, err
 			default:
-				logger.Error(err)
+				results = append(results, changeFailed(user, err))
 				continue
 			}
 		}
@@ -196,16 +354,27 @@ func (g GitHub) AddMembers(teamSlug string, users []User) error {
 			},
 		)
 		if err != nil {
-			logger.Error(err)
+			results = append(results, changeFailed(user, err))
+			continue
 		}
-		fmt.Println(membership)
+
+		logger.Infof(
+			"Added %s to team %s (%s)",
+			ghIdentity.Login,
+			teamSlug,
+			membership.GetState(),
+		)
+		results = append(results, changeCommitted(user))
 	}
 
-	return nil
+	return results, nil
 }
 
-func (g GitHub) RemoveMembers(teamSlug string, users []User) error {
-	g.initClient()
+func (g *GitHub) RemoveMembers(teamSlug string, users []User) ([]ChangeResult, error) {
+	err := g.initClient()
+	if err != nil {
+		return nil, err
+	}
 
 	team, _, err := g.v3client.Teams.GetTeamBySlug(
 		context.Background(),
@@ -213,17 +382,19 @@ func (g GitHub) RemoveMembers(teamSlug string, users []User) error {
 		teamSlug,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var results []ChangeResult
+
 	for _, user := range users {
-		identity, err := user.getIdentity("github")
+		identity, err := user.getIdentity(g.name)
 		if err != nil {
 			switch err.(type) {
 			case FatalError:
-				return err
+				return results, err
 			default:
-				logger.Error(err)
+				results = append(results, changeFailed(user, err))
 				continue
 			}
 		}
@@ -236,26 +407,75 @@ func (g GitHub) RemoveMembers(teamSlug string, users []User) error {
 			ghIdentity.Login,
 		)
 		if err != nil {
-			logger.Error(err)
+			results = append(results, changeFailed(user, err))
+			continue
 		}
+
+		results = append(results, changeCommitted(user))
 	}
 
-	return nil
+	return results, nil
 }
 
-func (g *GitHub) initClient() {
+func (g *GitHub) initClient() error {
+	g.clientMutex.Lock()
+	defer g.clientMutex.Unlock()
+
 	if g.v4client == nil && g.v3client == nil {
-		src := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: g.cfg.Token},
-		)
+		src, err := g.tokenSource()
+		if err != nil {
+			return err
+		}
 		httpClient := oauth2.NewClient(context.Background(), src)
 
-		g.v4client = githubv4.NewClient(httpClient)
-		g.v3client = githubv3.NewClient(httpClient)
+		g.v3client, err = newGitHubV3Client(g.cfg, httpClient)
+		if err != nil {
+			return err
+		}
+
+		if g.cfg.BaseURL != "" {
+			g.v4client = githubv4.NewEnterpriseClient(
+				strings.TrimSuffix(g.cfg.BaseURL, "/")+"/api/graphql",
+				httpClient,
+			)
+		} else {
+			g.v4client = githubv4.NewClient(httpClient)
+		}
 	} else if g.v4client == nil || g.v3client == nil {
 		panic("only one of the v3 and v4 github clients is defined; " +
 			"this shouldn't happen")
 	}
+
+	return nil
+}
+
+// newGitHubV3Client creates a REST API client for either github.com or the
+// configured GitHub Enterprise Server instance.
+func newGitHubV3Client(
+	cfg GitHubConfig,
+	httpClient *http.Client,
+) (*githubv3.Client, error) {
+	if cfg.BaseURL == "" {
+		return githubv3.NewClient(httpClient), nil
+	}
+
+	base := strings.TrimSuffix(cfg.BaseURL, "/")
+
+	return githubv3.NewEnterpriseClient(
+		base+"/api/v3/",
+		base+"/api/uploads/",
+		httpClient,
+	)
+}
+
+func (g *GitHub) tokenSource() (oauth2.TokenSource, error) {
+	if g.cfg.AppID != 0 {
+		return newGitHubAppTokenSource(g.cfg)
+	}
+
+	return oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: g.cfg.Token},
+	), nil
 }
 
 func (g *GitHub) getAllGitHubMappings() (map[string]GitHubSAMLMapping, error) {
@@ -263,6 +483,9 @@ func (g *GitHub) getAllGitHubMappings() (map[string]GitHubSAMLMapping, error) {
 		return nil, fmt.Errorf("nil GitHub object passed to getAllGitHubMappings")
 	}
 
+	g.mappingsMutex.Lock()
+	defer g.mappingsMutex.Unlock()
+
 	if g.mappingsCache == nil {
 		mappings, err := g.acquireAllGitHubMappings()
 		if err != nil {
@@ -273,10 +496,29 @@ func (g *GitHub) getAllGitHubMappings() (map[string]GitHubSAMLMapping, error) {
 	return g.mappingsCache, nil
 }
 
+// samlNameID returns the SAML identity linked to the GitHub user `login`.
+func (g *GitHub) samlNameID(login string) (string, error) {
+	mappings, err := g.getAllGitHubMappings()
+	if err != nil {
+		return "", newFatalError("acquiring all SAML mappings", err)
+	}
+
+	for nameID, mapping := range mappings {
+		if mapping.User.Login == login {
+			return nameID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no github SAML mapping found for `%s`", login)
+}
+
 // acquireAllGitHubMappings fetches all the mappings of GitHub identities to SAML
 // identities within the given org.
 func (g *GitHub) acquireAllGitHubMappings() (map[string]GitHubSAMLMapping, error) {
-	g.initClient()
+	err := g.initClient()
+	if err != nil {
+		return nil, err
+	}
 
 	logger.Info("Acquiring all GitHub SAML mappings...")
 
@@ -322,7 +564,7 @@ func (g *GitHub) acquireAllGitHubMappings() (map[string]GitHubSAMLMapping, error
 		"org": githubv4.String(g.cfg.Org),
 	}
 
-	err := g.v4client.Query(
+	err = g.v4client.Query(
 		context.Background(),
 		&firstQuery,
 		vars,
@@ -0,0 +1,186 @@
+package services
+
+// Authentication as a GitHub App, using installation access tokens.
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	githubv3 "github.com/google/go-github/v28/github"
+	"github.com/google/logger"
+	"golang.org/x/oauth2"
+)
+
+// githubAppTokenSource mints installation access tokens for a GitHub App.
+// It's meant to be wrapped in oauth2.ReuseTokenSource (which oauth2.NewClient
+// does), so that a new token is only minted once the previous one expires.
+type githubAppTokenSource struct {
+	appID          int64
+	installationID int64
+	org            string
+	key            *rsa.PrivateKey
+
+	// A client authenticated as the app itself.
+	client *githubv3.Client
+}
+
+func newGitHubAppTokenSource(cfg GitHubConfig) (*githubAppTokenSource, error) {
+	pemData, err := ioutil.ReadFile(cfg.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read GitHub App private key: %v", err)
+	}
+
+	key, err := parseRSAPrivateKey(pemData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse GitHub App private key: %v", err)
+	}
+
+	src := &githubAppTokenSource{
+		appID:          cfg.AppID,
+		installationID: cfg.InstallationID,
+		org:            cfg.Org,
+		key:            key,
+	}
+
+	src.client, err = newGitHubV3Client(cfg, &http.Client{
+		Transport: &githubAppTransport{src: src},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return src, nil
+}
+
+// Token implements oauth2.TokenSource.
+func (s *githubAppTokenSource) Token() (*oauth2.Token, error) {
+	if s.installationID == 0 {
+		installation, _, err := s.client.Apps.FindOrganizationInstallation(
+			context.Background(),
+			s.org,
+		)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"cannot find the GitHub App installation for org `%s`: %v",
+				s.org,
+				err,
+			)
+		}
+
+		s.installationID = installation.GetID()
+		logger.Infof("Using GitHub App installation %d.", s.installationID)
+	}
+
+	logger.Info("Minting a GitHub App installation token...")
+
+	token, _, err := s.client.Apps.CreateInstallationToken(
+		context.Background(),
+		s.installationID,
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"cannot create a GitHub App installation token: %v",
+			err,
+		)
+	}
+
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "token",
+		Expiry:      token.GetExpiresAt(),
+	}, nil
+}
+
+// jwt creates a JSON Web Token authenticating requests as the app itself.
+func (s *githubAppTokenSource) jwt() (string, error) {
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]int64{
+		// Backdated to allow for clock drift, as GitHub recommends.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": s.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// githubAppTransport authenticates requests with the app's JWT.
+type githubAppTransport struct {
+	src  *githubAppTokenSource
+	base http.RoundTripper
+}
+
+func (t *githubAppTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	jwt, err := t.src.jwt()
+	if err != nil {
+		return nil, err
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// RoundTrippers shouldn't modify the original request.
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+jwt)
+
+	return base.RoundTrip(authorized)
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key isn't an RSA key")
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestGitHubAppTokens(t *testing.T) {
+	key, keyFile := newTestRSAKey()
+	defer os.Remove(keyFile)
+
+	lookups := 0
+	minted := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assertAppJWT(r, &key.PublicKey, 1234)
+			w.Header().Set("Content-Type", "application/json")
+
+			switch r.URL.Path {
+			case "/orgs/my-org/installation":
+				lookups++
+				fmt.Fprint(w, `{"id": 42}`)
+			case "/app/installations/42/access_tokens":
+				minted++
+				// The first token is already about to expire, which should
+				// make the caller mint another one right away.
+				expiry := time.Now().Add(time.Second)
+				if minted > 1 {
+					expiry = time.Now().Add(time.Hour)
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"token":      fmt.Sprintf("installation-token-%d", minted),
+					"expires_at": expiry,
+				})
+			default:
+				panic("unexpected request: " + r.URL.String())
+			}
+		},
+	))
+	defer srv.Close()
+
+	appSrc, err := newGitHubAppTokenSource(GitHubConfig{
+		Org:            "my-org",
+		AppID:          1234,
+		PrivateKeyPath: keyFile,
+	})
+	if err != nil {
+		panic(err)
+	}
+	appSrc.client.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	src := oauth2.ReuseTokenSource(nil, appSrc)
+
+	for i := 0; i < 3; i++ {
+		token, err := src.Token()
+		if err != nil {
+			panic(err)
+		}
+
+		if token.AccessToken != "installation-token-2" && i > 0 {
+			panic("unexpected token: " + token.AccessToken)
+		}
+	}
+
+	if lookups != 1 || minted != 2 {
+		panic(fmt.Sprintf(
+			"expected 1 installation lookup and 2 tokens minted, got %d and %d",
+			lookups,
+			minted,
+		))
+	}
+}
+
+// Helpers
+
+func newTestRSAKey() (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := ioutil.TempFile("", "groupsync-key-*.pem")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	err = pem.Encode(file, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return key, file.Name()
+}
+
+func assertAppJWT(r *http.Request, key *rsa.PublicKey, appID int64) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		panic("request not authenticated with a JWT: " + auth)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(auth, "Bearer "), ".")
+	if len(parts) != 3 {
+		panic("malformed JWT: " + auth)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		panic(err)
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	if err != nil {
+		panic(err)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		panic(err)
+	}
+
+	var claims map[string]int64
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		panic(err)
+	}
+
+	if claims["iss"] != appID {
+		panic(fmt.Sprintf("unexpected JWT issuer %d", claims["iss"]))
+	}
+}
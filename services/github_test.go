@@ -0,0 +1,233 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	githubv3 "github.com/google/go-github/v28/github"
+	"github.com/shurcooL/githubv4"
+)
+
+func TestGitHubGroupMembersPagination(t *testing.T) {
+	const teamSize = 3456
+	const pageSize = 100
+
+	queries := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			queries++
+
+			var req graphQLRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				panic(err)
+			}
+
+			if !strings.Contains(req.Query, "members(first: $page_size, after: $page_cursor)") {
+				panic("team members queried without pagination: " + req.Query)
+			}
+
+			first := int(req.Variables["page_size"].(float64))
+			start := 0
+			if cursor, ok := req.Variables["page_cursor"].(string); ok {
+				start, err = strconv.Atoi(cursor)
+				if err != nil {
+					panic(err)
+				}
+			}
+
+			end := start + first
+			if end > teamSize {
+				end = teamSize
+			}
+
+			var edges []map[string]interface{}
+			for i := start; i < end; i++ {
+				edges = append(edges, map[string]interface{}{
+					"node": map[string]string{
+						"id":    fmt.Sprintf("id-%d", i),
+						"login": fmt.Sprintf("user%d", i),
+					},
+				})
+			}
+
+			writeGraphQLData(w, map[string]interface{}{
+				"viewer": map[string]interface{}{
+					"organization": map[string]interface{}{
+						"team": map[string]interface{}{
+							"name": "big-team",
+							"members": map[string]interface{}{
+								"edges": edges,
+								"pageInfo": map[string]interface{}{
+									"endCursor":   strconv.Itoa(end),
+									"hasNextPage": end < teamSize,
+								},
+							},
+						},
+					},
+				},
+			})
+		},
+	))
+	defer srv.Close()
+
+	g := newTestGitHub(srv, GitHubConfig{Org: "my-org", PageSize: pageSize})
+
+	members, err := g.GroupMembers("big-team")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(members) != teamSize {
+		panic(fmt.Sprintf("expected %d members, got %d", teamSize, len(members)))
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range members {
+		seen[m.identities["github"].uniqueID()] = true
+	}
+	if len(seen) != teamSize {
+		panic(fmt.Sprintf("expected %d unique members, got %d", teamSize, len(seen)))
+	}
+
+	if queries != (teamSize+pageSize-1)/pageSize {
+		panic(fmt.Sprintf("unexpected number of queries: %d", queries))
+	}
+}
+
+func TestGitHubEnterpriseServer(t *testing.T) {
+	added := ""
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer my-token" {
+				panic("request not authenticated with the token")
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+
+			switch {
+			case r.URL.Path == "/api/graphql":
+				writeGraphQLData(w, map[string]interface{}{
+					"viewer": map[string]interface{}{
+						"organization": map[string]interface{}{
+							"team": map[string]interface{}{
+								"name": "my-team",
+								"members": map[string]interface{}{
+									"edges": []interface{}{
+										map[string]interface{}{
+											"node": map[string]string{
+												"id":    "id-1",
+												"login": "user1",
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				})
+			case r.URL.Path == "/api/v3/orgs/my-org/teams/my-team":
+				fmt.Fprint(w, `{"id": 7, "slug": "my-team"}`)
+			case strings.HasPrefix(r.URL.Path, "/api/v3/teams/7/memberships/"):
+				added = strings.TrimPrefix(r.URL.Path, "/api/v3/teams/7/memberships/")
+				fmt.Fprint(w, `{"state": "active", "role": "member"}`)
+			default:
+				panic("unexpected request: " + r.URL.String())
+			}
+		},
+	))
+	defer srv.Close()
+
+	g := NewGitHub("github", GitHubConfig{
+		Token:   "my-token",
+		Org:     "my-org",
+		BaseURL: srv.URL + "/",
+	})
+
+	members, err := g.GroupMembers("my-team")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(members) != 1 {
+		panic(fmt.Sprintf("expected 1 member, got %d", len(members)))
+	}
+
+	user := newUser()
+	user.addIdentity("github", GitHubIdentity{ID: "id-2", Login: "user2"})
+
+	results, err := g.AddMembers("my-team", []User{user})
+	if err != nil {
+		panic(err)
+	}
+
+	if len(results) != 1 || results[0].Err != nil {
+		panic(fmt.Sprintf("unexpected results of adding user2: %v", results))
+	}
+
+	if added != "user2" {
+		panic("user2 wasn't added to the team, got: " + added)
+	}
+}
+
+func TestGitHubIdentityFromOtherInstance(t *testing.T) {
+	oss := NewGitHub("oss-github-test", GitHubConfig{Org: "foo"})
+	inner := NewGitHub("inner-github-test", GitHubConfig{Org: "bar"})
+	ghes := NewGitHub("ghes-test", GitHubConfig{
+		Org:     "baz",
+		BaseURL: "https://github.my-org.com",
+	})
+	saveSvcInCache(oss.name, oss)
+	saveSvcInCache(inner.name, inner)
+	saveSvcInCache(ghes.name, ghes)
+
+	user := newUser()
+	user.addIdentity(oss.name, GitHubIdentity{ID: "id-1", Login: "user1"})
+
+	id, err := user.getIdentity(inner.name)
+	if err != nil {
+		panic(err)
+	}
+
+	if id.uniqueID() != "id-1" {
+		panic("identity from an instance on the same server should be reused")
+	}
+
+	_, err = user.getIdentity(ghes.name)
+	if err == nil {
+		panic("identity from an instance on another server shouldn't be reused")
+	}
+}
+
+// Helpers
+
+type graphQLRequest struct {
+	Query     string
+	Variables map[string]interface{}
+}
+
+func writeGraphQLData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": data,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newTestGitHub creates a GitHub instance talking to a fake API server.
+func newTestGitHub(srv *httptest.Server, cfg GitHubConfig) *GitHub {
+	g := NewGitHub("github", cfg)
+	g.v4client = githubv4.NewEnterpriseClient(srv.URL, srv.Client())
+	g.v3client = githubv3.NewClient(srv.Client())
+
+	return g
+}
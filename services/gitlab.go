@@ -0,0 +1,467 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitLab contains the GitLab config and the HTTP client used to talk to the
+// GitLab REST API.
+type GitLab struct {
+	name   string
+	client *http.Client
+	cfg    GitLabConfig
+}
+
+type GitLabConfig struct {
+	// The URL of the GitLab instance. Defaults to https://gitlab.com.
+	BaseURL string `mapstructure:"base_url"`
+	Token   string
+
+	// The access level given to added members: guest, reporter, developer
+	// (the default), maintainer or owner.
+	AccessLevel string `mapstructure:"access_level"`
+
+	// The LDAP provider of the external identities (e.g. `ldapmain`), which
+	// GitLab identifies by the DN of the LDAP user. If not set, the emails
+	// of LDAP users are matched against the primary emails of GitLab users
+	// instead. Both require an admin token.
+	ExternProvider string `mapstructure:"extern_provider"`
+
+	// How long to wait for a response to every API request. Defaults to 30s.
+	Timeout time.Duration
+}
+
+const defaultGitLabTimeout = 30 * time.Second
+
+func (c *GitLabConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultGitLabTimeout
+	}
+
+	return c.Timeout
+}
+
+var gitLabAccessLevels = map[string]int{
+	"guest":      10,
+	"reporter":   20,
+	"developer":  30,
+	"maintainer": 40,
+	"owner":      50,
+}
+
+type GitLabIdentity struct {
+	ID       int
+	Username string
+}
+
+// Implement Identity for GitLabIdentity.
+func (i GitLabIdentity) uniqueID() string {
+	return strconv.Itoa(i.ID)
+}
+
+func (i GitLabIdentity) userID() string {
+	return i.Username
+}
+
+func (i GitLabIdentity) String() string {
+	return fmt.Sprintf("gitlab{id: %d, username: %s}", i.ID, i.Username)
+}
+
+// gitLabUser is a user as returned by the GitLab API.
+type gitLabUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	// The primary email, only visible to admins.
+	Email string `json:"email"`
+}
+
+func (u gitLabUser) identity() GitLabIdentity {
+	return GitLabIdentity{
+		ID:       u.ID,
+		Username: u.Username,
+	}
+}
+
+// NewGitLab creates a new instance of GitLab called `name` with the provided
+// configuration.
+func NewGitLab(name string, cfg GitLabConfig) *GitLab {
+	return &GitLab{
+		name:   name,
+		client: &http.Client{Timeout: cfg.timeout()},
+		cfg:    cfg,
+	}
+}
+
+// Implement Service for GitLab.
+
+// GroupMembers returns the direct members of the group with the full path
+// `group`, e.g. `my-org/my-group`.
+func (g *GitLab) GroupMembers(group string) ([]User, error) {
+	var result []User
+
+	page := "1"
+	for page != "" {
+		var members []gitLabUser
+
+		resp, err := g.request(
+			"GET",
+			fmt.Sprintf("groups/%s/members", url.PathEscape(group)),
+			url.Values{"per_page": {"100"}, "page": {page}},
+			nil,
+			&members,
+		)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error looking up members of GitLab group `%s`: %v",
+				group,
+				err,
+			)
+		}
+
+		for _, m := range members {
+			user := newUser()
+			user.addIdentity(g.name, m.identity())
+			result = append(result, user)
+		}
+
+		page = resp.Header.Get("X-Next-Page")
+	}
+
+	return result, nil
+}
+
+// ListGroups returns the full paths of all the groups visible to the token.
+// Implements the GroupLister interface.
+func (g *GitLab) ListGroups() ([]string, error) {
+	var result []string
+
+	page := "1"
+	for page != "" {
+		var groups []struct {
+			FullPath string `json:"full_path"`
+		}
+
+		resp, err := g.request(
+			"GET",
+			"groups",
+			url.Values{"per_page": {"100"}, "page": {page}},
+			nil,
+			&groups,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error listing GitLab groups: %v", err)
+		}
+
+		for _, grp := range groups {
+			result = append(result, grp.FullPath)
+		}
+
+		page = resp.Header.Get("X-Next-Page")
+	}
+
+	return result, nil
+}
+
+// Implement Target for GitLab.
+
+func (g *GitLab) acquireIdentity(user *User) (Identity, error) {
+	// Identities from other instances pointing to the same GitLab server are
+	// just as good.
+	glIdentity, ok := user.findIdentity(func(svc string, i Identity) bool {
+		_, isGitLab := i.(GitLabIdentity)
+		return isGitLab && g.sameServer(svc)
+	})
+	if ok {
+		return glIdentity, nil
+	}
+
+	var ldapSvc string
+	ldapIdentity, ok := user.findIdentity(func(svc string, i Identity) bool {
+		if _, isLDAP := i.(LDAPIdentity); isLDAP {
+			ldapSvc = svc
+			return true
+		}
+		return false
+	})
+	if ok {
+		return g.identityFromLDAP(ldapSvc, ldapIdentity)
+	}
+
+	emailIdentity, ok := user.findIdentity(func(_ string, i Identity) bool {
+		_, isEmail := i.(EmailIdentity)
+		return isEmail
+	})
+	if ok {
+		return g.findUserByEmail(emailIdentity.userID())
+	}
+
+	return nil, fmt.Errorf(
+		"couldn't acquire gitlab identity for user:\n%v",
+		user,
+	)
+}
+
+// identityFromLDAP finds the GitLab user linked to the LDAP user - by the DN
+// of their LDAP identity if an external provider is configured, or by their
+// email otherwise.
+func (g *GitLab) identityFromLDAP(svc string, i Identity) (Identity, error) {
+	src, err := SvcFromString(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, ok := src.(ldapUserDirectory)
+	if !ok {
+		return nil, fmt.Errorf("cannot look up LDAP users in `%s`", svc)
+	}
+
+	entry, err := dir.lookUpUser(i.uniqueID())
+	if err != nil {
+		return nil, err
+	}
+
+	if g.cfg.ExternProvider != "" {
+		return g.findUser(url.Values{
+			"extern_uid": {entry.dn},
+			"provider":   {g.cfg.ExternProvider},
+		})
+	}
+
+	if entry.email == "" {
+		return nil, fmt.Errorf("LDAP user `%s` has no email", i.uniqueID())
+	}
+
+	return g.findUserByEmail(entry.email)
+}
+
+func (g *GitLab) identityFromUID(username string) (Identity, error) {
+	return g.findUser(url.Values{"username": {username}})
+}
+
+func (g *GitLab) AddMembers(group string, users []User) ([]ChangeResult, error) {
+	accessLevel, err := g.accessLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ChangeResult
+
+	for _, user := range users {
+		identity, err := user.getIdentity(g.name)
+		if err != nil {
+			switch err.(type) {
+			case FatalError:
+				return results, err
+			default:
+				results = append(results, changeFailed(user, err))
+				continue
+			}
+		}
+
+		glIdentity := identity.(GitLabIdentity)
+
+		_, err = g.request(
+			"POST",
+			fmt.Sprintf("groups/%s/members", url.PathEscape(group)),
+			nil,
+			map[string]int{
+				"user_id":      glIdentity.ID,
+				"access_level": accessLevel,
+			},
+			nil,
+		)
+		if err != nil {
+			results = append(results, changeFailed(user, err))
+			continue
+		}
+
+		results = append(results, changeCommitted(user))
+	}
+
+	return results, nil
+}
+
+func (g *GitLab) RemoveMembers(group string, users []User) ([]ChangeResult, error) {
+	var results []ChangeResult
+
+	for _, user := range users {
+		identity, err := user.getIdentity(g.name)
+		if err != nil {
+			switch err.(type) {
+			case FatalError:
+				return results, err
+			default:
+				results = append(results, changeFailed(user, err))
+				continue
+			}
+		}
+
+		glIdentity := identity.(GitLabIdentity)
+
+		_, err = g.request(
+			"DELETE",
+			fmt.Sprintf(
+				"groups/%s/members/%d",
+				url.PathEscape(group),
+				glIdentity.ID,
+			),
+			nil,
+			nil,
+			nil,
+		)
+		if err != nil {
+			results = append(results, changeFailed(user, err))
+			continue
+		}
+
+		results = append(results, changeCommitted(user))
+	}
+
+	return results, nil
+}
+
+func (g *GitLab) accessLevel() (int, error) {
+	if g.cfg.AccessLevel == "" {
+		return gitLabAccessLevels["developer"], nil
+	}
+
+	level, ok := gitLabAccessLevels[strings.ToLower(g.cfg.AccessLevel)]
+	if !ok {
+		return 0, fmt.Errorf(
+			"unknown GitLab access level `%s`",
+			g.cfg.AccessLevel,
+		)
+	}
+
+	return level, nil
+}
+
+// sameServer checks whether the service `svc` is a GitLab instance talking to
+// the same server as this one.
+func (g *GitLab) sameServer(svc string) bool {
+	other, err := SvcFromString(svc)
+	if err != nil {
+		return false
+	}
+
+	otherGitLab, ok := other.(*GitLab)
+	return ok && otherGitLab.baseURL() == g.baseURL()
+}
+
+// findUser looks up a single user with the GitLab user search API.
+func (g *GitLab) findUser(query url.Values) (Identity, error) {
+	var users []gitLabUser
+
+	_, err := g.request("GET", "users", query, nil, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) != 1 {
+		return nil, fmt.Errorf(
+			"expected exactly one GitLab user matching %v, found %d",
+			query.Encode(),
+			len(users),
+		)
+	}
+
+	return users[0].identity(), nil
+}
+
+func (g *GitLab) findUserByEmail(email string) (Identity, error) {
+	var users []gitLabUser
+
+	_, err := g.request("GET", "users", url.Values{"search": {email}}, nil, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	// The search matches on more than just emails, and partially at that.
+	// Only the primary email is trusted, as public emails aren't verified.
+	for _, u := range users {
+		if strings.EqualFold(u.Email, email) {
+			return u.identity(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no GitLab user with the email %s found", email)
+}
+
+func (g *GitLab) baseURL() string {
+	if g.cfg.BaseURL == "" {
+		return "https://gitlab.com"
+	}
+
+	return strings.TrimSuffix(g.cfg.BaseURL, "/")
+}
+
+// request calls the GitLab API. `body` is sent as JSON if not nil, and the
+// JSON response is decoded into `result` if not nil.
+func (g *GitLab) request(
+	method string,
+	path string,
+	query url.Values,
+	body interface{},
+	result interface{},
+) (*http.Response, error) {
+	u := fmt.Sprintf("%s/api/v4/%s", g.baseURL(), path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, &reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("PRIVATE-TOKEN", g.cfg.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		return resp, fmt.Errorf(
+			"GitLab API call %s %s failed with %s: %s",
+			method,
+			path,
+			resp.Status,
+			strings.TrimSpace(string(data)),
+		)
+	}
+
+	if result != nil {
+		err = json.Unmarshal(data, result)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGitLab is an in-memory stand-in for the GitLab API, holding a single
+// group.
+type fakeGitLab struct {
+	users   []gitLabUser
+	members map[int]int // user ID -> access level
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("PRIVATE-TOKEN") != "my-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const groupPath = "/api/v4/groups/my-org%2Fmy-group/members"
+	path := r.URL.EscapedPath()
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "GET" && path == groupPath:
+		var ids []int
+		for id := range f.members {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+
+		// Pages of 2 members, to exercise pagination.
+		page, _ := strconv.Atoi(query.Get("page"))
+		start := (page - 1) * 2
+		end := start + 2
+		if end >= len(ids) {
+			end = len(ids)
+		} else {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+
+		var result []gitLabUser
+		for _, id := range ids[start:end] {
+			result = append(result, f.user(id))
+		}
+		json.NewEncoder(w).Encode(result)
+	case r.Method == "POST" && path == groupPath:
+		var body map[string]int
+		json.NewDecoder(r.Body).Decode(&body)
+		f.members[body["user_id"]] = body["access_level"]
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "{}")
+	case r.Method == "DELETE" && strings.HasPrefix(path, groupPath+"/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(path, groupPath+"/"))
+		delete(f.members, id)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && path == "/api/v4/users":
+		var result []gitLabUser
+		for _, u := range f.users {
+			switch {
+			case query.Get("username") == u.Username,
+				query.Get("provider") == "ldapmain" &&
+					query.Get("extern_uid") == testLDAPDN(u.Username),
+				query.Get("search") != "" && strings.Contains(
+					strings.ToLower(u.Email),
+					strings.ToLower(query.Get("search")),
+				):
+				result = append(result, u)
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		panic("unexpected request: " + r.Method + " " + r.URL.String())
+	}
+}
+
+func (f *fakeGitLab) user(id int) gitLabUser {
+	for _, u := range f.users {
+		if u.ID == id {
+			return u
+		}
+	}
+
+	panic(fmt.Sprintf("no user with ID %d", id))
+}
+
+func testLDAPDN(uid string) string {
+	return fmt.Sprintf("uid=%s,ou=people,dc=my-org,dc=com", uid)
+}
+
+// fakeLDAPDirectory stands in for an LDAP service holding the users of
+// fakeGitLab under the uid `jdoe<N>`.
+type fakeLDAPDirectory struct{}
+
+func (fakeLDAPDirectory) GroupMembers(group string) ([]User, error) {
+	return nil, fmt.Errorf("no groups in the fake LDAP directory")
+}
+
+func (fakeLDAPDirectory) lookUpUser(uid string) (ldapUser, error) {
+	n := strings.TrimPrefix(uid, "jdoe")
+	if n == uid {
+		return ldapUser{}, fmt.Errorf("LDAP user `%s` not found", uid)
+	}
+
+	return ldapUser{
+		dn:    testLDAPDN("user" + n),
+		email: fmt.Sprintf("User%s@My-Org.com", n),
+	}, nil
+}
+
+func newFakeGitLab() *fakeGitLab {
+	f := &fakeGitLab{
+		members: map[int]int{1: 30, 2: 30, 3: 30},
+	}
+
+	for i := 1; i <= 5; i++ {
+		f.users = append(f.users, gitLabUser{
+			ID:       i,
+			Username: fmt.Sprintf("user%d", i),
+			Email:    fmt.Sprintf("user%d@my-org.com", i),
+		})
+	}
+
+	return f
+}
+
+func TestGitLabGroupMembers(t *testing.T) {
+	srv := httptest.NewServer(newFakeGitLab())
+	defer srv.Close()
+
+	g := NewGitLab("gitlab", GitLabConfig{BaseURL: srv.URL, Token: "my-token"})
+
+	members, err := g.GroupMembers("my-org/my-group")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(members) != 3 {
+		panic(fmt.Sprintf("expected 3 members, got %v", members))
+	}
+}
+
+func TestGitLabAddRemoveMembers(t *testing.T) {
+	fake := newFakeGitLab()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	g := NewGitLab("gitlab", GitLabConfig{
+		BaseURL:     srv.URL,
+		Token:       "my-token",
+		AccessLevel: "maintainer",
+	})
+
+	add := newUser()
+	add.addIdentity("gitlab", GitLabIdentity{ID: 4, Username: "user4"})
+	rem := newUser()
+	rem.addIdentity("gitlab", GitLabIdentity{ID: 1, Username: "user1"})
+
+	_, err := g.AddMembers("my-org/my-group", []User{add})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = g.RemoveMembers("my-org/my-group", []User{rem})
+	if err != nil {
+		panic(err)
+	}
+
+	if fake.members[4] != 40 {
+		panic("user4 should have been added as a maintainer")
+	}
+
+	if _, ok := fake.members[1]; ok {
+		panic("user1 should have been removed")
+	}
+}
+
+func TestGitLabAcquireIdentity(t *testing.T) {
+	srv := httptest.NewServer(newFakeGitLab())
+	defer srv.Close()
+
+	saveSvcInCache("gitlab-test-ldap", fakeLDAPDirectory{})
+	defer delete(initializedServices, "gitlab-test-ldap")
+
+	var cases = []GitLabConfig{
+		// By the DN of the user's LDAP identity.
+		{ExternProvider: "ldapmain"},
+		// By the user's email in LDAP.
+		{},
+	}
+
+	for _, cfg := range cases {
+		cfg.BaseURL = srv.URL
+		cfg.Token = "my-token"
+		g := NewGitLab("gitlab", cfg)
+
+		user := newUser()
+		user.addIdentity("gitlab-test-ldap", LDAPIdentity{id: "jdoe2"})
+
+		id, err := g.acquireIdentity(&user)
+		if err != nil {
+			panic(err)
+		}
+
+		if id.(GitLabIdentity).Username != "user2" {
+			panic(fmt.Sprintf("unexpected identity acquired: %v", id))
+		}
+	}
+
+	g := NewGitLab("gitlab", GitLabConfig{BaseURL: srv.URL, Token: "my-token"})
+
+	user, err := userFromRef("email:user4@my-org.com", "gitlab")
+	if err != nil {
+		panic(err)
+	}
+
+	id, err := g.acquireIdentity(&user)
+	if err != nil {
+		panic(err)
+	}
+
+	if id.(GitLabIdentity).Username != "user4" {
+		panic(fmt.Sprintf("unexpected identity acquired by email: %v", id))
+	}
+
+	id, err = g.identityFromUID("user3")
+	if err != nil {
+		panic(err)
+	}
+
+	if id.uniqueID() != "3" {
+		panic(fmt.Sprintf("unexpected identity: %v", id))
+	}
+}
+
+func TestGitLabTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-hung
+		},
+	))
+	defer srv.Close()
+	defer close(hung)
+
+	g := NewGitLab("gitlab", GitLabConfig{
+		BaseURL: srv.URL,
+		Token:   "my-token",
+		Timeout: 50 * time.Millisecond,
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := g.GroupMembers("my-org/my-group")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			panic("expected an error for a request that timed out")
+		}
+	case <-time.After(5 * time.Second):
+		panic("request to an unresponsive GitLab didn't time out")
+	}
+
+	if NewGitLab("gitlab", GitLabConfig{}).client.Timeout != defaultGitLabTimeout {
+		panic("GitLab requests should time out by default")
+	}
+}
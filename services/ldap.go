@@ -2,15 +2,28 @@ package services
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/logger"
+	"gopkg.in/asn1-ber.v1"
 	"gopkg.in/ldap.v3"
 )
 
 // LDAP contains the LDAP config and (once established) the active connection
 // to an LDAP server.
 type LDAP struct {
+	name string
 	conn *ldap.Conn
 	cfg  LDAPConfig
 }
@@ -28,6 +41,10 @@ func (i LDAPIdentity) uniqueID() string {
 	return i.id
 }
 
+func (i LDAPIdentity) userID() string {
+	return i.uniqueID()
+}
+
 func (i LDAPIdentity) String() string {
 	return fmt.Sprintf("ldap{uid: %s}", i.uniqueID())
 }
@@ -40,8 +57,32 @@ type LDAPConfig struct {
 	Port       int32
 	Server     string
 	SSL        bool
+	StartTLS   bool `mapstructure:"start_tls"`
 	SkipVerify bool `mapstructure:"skip_verify"`
 
+	// Failover
+	// Servers to use instead of Server, either as `host[:port]` (connected
+	// to according to SSL and Port) or as `ldap://` or `ldaps://` URLs.
+	Servers []string
+	// "ordered" (the default) always tries Servers in the given order,
+	// "round_robin" starts with the next server on every connection.
+	ServerSelection string `mapstructure:"server_selection"`
+	// How long to wait for a server, both when connecting and for every
+	// request. Defaults to 10s.
+	Timeout time.Duration
+
+	// TLS
+	// A PEM bundle of CAs to verify the server certificate with, instead of
+	// the system ones.
+	CAFile string `mapstructure:"ca_file"`
+	// The name the server certificate is verified against. Defaults to
+	// Server.
+	ServerName string `mapstructure:"server_name"`
+	// A client certificate and key to present to the server. Without a bind
+	// user, the certificate is also used to bind (SASL EXTERNAL).
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+
 	// Auth
 	BindUser     string `mapstructure:"bind_user"`
 	BindPassword string `mapstructure:"bind_password"`
@@ -52,163 +93,1485 @@ type LDAPConfig struct {
 	UserClass       string `mapstructure:"user_class"`
 	SearchAttribute string `mapstructure:"search_attribute"`
 	UserIDAttribute string `mapstructure:"user_id_attribute"`
+	// The attribute users referenced by email are looked up by. Defaults
+	// to `mail`.
+	EmailAttribute string `mapstructure:"email_attribute"`
+
+	// Group schema. Default to Active Directory-style groups, i.e.
+	// `(&(objectClass=group)(cn=<group name>))`.
+	GroupClass         string `mapstructure:"group_class"`
+	GroupNameAttribute string `mapstructure:"group_name_attribute"`
+
+	// How group membership is stored:
+	// - "member_of" (the default): users reference the DNs of their groups
+	//   in SearchAttribute,
+	// - "member": groups list the DNs of their members in
+	//   GroupMemberAttribute (`member` by default, `uniqueMember` for
+	//   groupOfUniqueNames),
+	// - "member_uid": groups list the user IDs of their members in
+	//   GroupMemberAttribute (`memberUid` by default, as in posixGroup),
+	//   matched against the MemberUIDAttribute (`uid` by default) of users.
+	Membership           string `mapstructure:"membership"`
+	GroupMemberAttribute string `mapstructure:"group_member_attribute"`
+	MemberUIDAttribute   string `mapstructure:"member_uid_attribute"`
+
+	// How to treat groups nested in other groups:
+	// - "" (the default): only direct members of a group are its members,
+	// - "in_chain": let the server resolve nested groups using the Active
+	//   Directory LDAP_MATCHING_RULE_IN_CHAIN rule,
+	// - "recursive": resolve nested groups by walking the `member`
+	//   attributes of groups.
+	NestedGroups string `mapstructure:"nested_groups"`
+
+	// The number of entries requested per page of search results. Should be
+	// below the size limit of the server. Defaults to 500.
+	PageSize uint32 `mapstructure:"page_size"`
+}
+
+const defaultLDAPPageSize = 500
+
+func (l *LDAPConfig) pageSize() uint32 {
+	if l.PageSize == 0 {
+		return defaultLDAPPageSize
+	}
+
+	return l.PageSize
+}
+
+// The Active Directory matching rule that walks the chain of ancestry.
+const ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// Values of LDAPConfig.Membership.
+const (
+	ldapMembershipMemberOf  = "member_of"
+	ldapMembershipMember    = "member"
+	ldapMembershipMemberUID = "member_uid"
+)
+
+func (l *LDAPConfig) membership() string {
+	if l.Membership == "" {
+		return ldapMembershipMemberOf
+	}
+
+	return l.Membership
+}
+
+func (l *LDAPConfig) emailAttribute() string {
+	if l.EmailAttribute == "" {
+		return "mail"
+	}
+
+	return l.EmailAttribute
+}
+
+func (l *LDAPConfig) groupClass() string {
+	if l.GroupClass == "" {
+		return "group"
+	}
+
+	return l.GroupClass
+}
+
+func (l *LDAPConfig) groupNameAttribute() string {
+	if l.GroupNameAttribute == "" {
+		return "cn"
+	}
+
+	return l.GroupNameAttribute
 }
 
-// NewLDAP creates a new instance of LDAP with the provided configuration.
-func NewLDAP(cfg LDAPConfig) *LDAP {
+func (l *LDAPConfig) groupMemberAttribute() string {
+	switch {
+	case l.GroupMemberAttribute != "":
+		return l.GroupMemberAttribute
+	case l.membership() == ldapMembershipMemberUID:
+		return "memberUid"
+	default:
+		return "member"
+	}
+}
+
+func (l *LDAPConfig) memberUIDAttribute() string {
+	if l.MemberUIDAttribute == "" {
+		return "uid"
+	}
+
+	return l.MemberUIDAttribute
+}
+
+// NewLDAP creates a new instance of LDAP called `name` with the provided
+// configuration.
+func NewLDAP(name string, cfg LDAPConfig) *LDAP {
 	return &LDAP{
-		cfg: cfg,
+		name: name,
+		cfg:  cfg,
 	}
 }
 
-func (l *LDAPConfig) connect() (*ldap.Conn, error) {
-	var c *ldap.Conn
-	var err error
-
-	if l.SSL {
-		c, err = ldap.DialTLS(
-			"tcp",
-			fmt.Sprintf("%s:%d", l.Server, l.Port),
-			&tls.Config{
-				InsecureSkipVerify: l.SkipVerify,
-			},
+// ldapServer is a single LDAP server to connect to.
+type ldapServer struct {
+	host string
+	port string
+	ssl  bool
+}
+
+func (s ldapServer) String() string {
+	scheme := "ldap"
+	if s.ssl {
+		scheme = "ldaps"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(s.host, s.port))
+}
+
+const defaultLDAPTimeout = 10 * time.Second
+
+// Incremented on every connection to spread them over servers when using
+// the `round_robin` server selection.
+var ldapRoundRobin uint32
+
+// ldapConnMutex guards the connections of all the LDAP services.
+var ldapConnMutex sync.Mutex
+
+// servers returns the servers to try connecting to, in order.
+func (l *LDAPConfig) servers() ([]ldapServer, error) {
+	addrs := l.Servers
+	if len(addrs) == 0 {
+		addrs = []string{l.Server}
+	}
+
+	var result []ldapServer
+
+	for _, addr := range addrs {
+		server, err := l.parseServer(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, server)
+	}
+
+	switch l.ServerSelection {
+	case "", "ordered":
+	case "round_robin":
+		start := int(atomic.AddUint32(&ldapRoundRobin, 1)-1) % len(result)
+		result = append(result[start:], result[:start]...)
+	default:
+		return nil, fmt.Errorf(
+			"unknown server_selection `%s`",
+			l.ServerSelection,
 		)
+	}
+
+	return result, nil
+}
+
+func (l *LDAPConfig) parseServer(addr string) (ldapServer, error) {
+	server := ldapServer{ssl: l.SSL}
+
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return server, fmt.Errorf("invalid LDAP server `%s`: %v", addr, err)
+		}
+
+		switch u.Scheme {
+		case "ldap":
+			server.ssl = false
+		case "ldaps":
+			server.ssl = true
+		default:
+			return server, fmt.Errorf(
+				"invalid LDAP server `%s`: unknown scheme `%s`",
+				addr,
+				u.Scheme,
+			)
+		}
+
+		server.host = u.Hostname()
+		server.port = u.Port()
+	} else if host, port, err := net.SplitHostPort(addr); err == nil {
+		server.host = host
+		server.port = port
 	} else {
-		c, err = ldap.Dial(
-			"tcp",
-			fmt.Sprintf("%s:%d", l.Server, l.Port),
+		server.host = addr
+	}
+
+	if server.host == "" {
+		return server, fmt.Errorf("invalid LDAP server `%s`: no host", addr)
+	}
+
+	if server.port == "" {
+		switch {
+		case !strings.Contains(addr, "://") && l.Port != 0:
+			server.port = strconv.Itoa(int(l.Port))
+		case server.ssl:
+			server.port = "636"
+		default:
+			server.port = "389"
+		}
+	}
+
+	return server, nil
+}
+
+func (l *LDAPConfig) timeout() time.Duration {
+	if l.Timeout == 0 {
+		return defaultLDAPTimeout
+	}
+
+	return l.Timeout
+}
+
+// connect connects to the first available server and binds.
+func (l *LDAPConfig) connect() (*ldap.Conn, error) {
+	servers, err := l.servers()
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []string
+
+	for _, server := range servers {
+		c, err := l.connectTo(server)
+		if err != nil {
+			logger.Warningf("Couldn't connect to LDAP server %s: %v", server, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", server, err))
+			continue
+		}
+
+		logger.Infof("Connected to LDAP server %s.", server)
+		return c, nil
+	}
+
+	return nil, fmt.Errorf(
+		"couldn't connect to any LDAP server:\n%s",
+		strings.Join(failures, "\n"),
+	)
+}
+
+func (l *LDAPConfig) connectTo(server ldapServer) (*ldap.Conn, error) {
+	if server.ssl && l.StartTLS {
+		return nil, errors.New("ssl and start_tls can't be used together")
+	}
+
+	if l.bindMethod() == ldapBindExternal && !server.ssl && !l.StartTLS {
+		return nil, errors.New(
+			"a client certificate can only be used with ssl or start_tls",
 		)
 	}
+
+	tlsConfig, err := l.tlsConfig(server.host)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.Bind(l.BindUser, l.BindPassword)
+	dialer := &net.Dialer{Timeout: l.timeout()}
+	addr := net.JoinHostPort(server.host, server.port)
+
+	var netConn net.Conn
+	if server.ssl {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", addr)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	isTLS := server.ssl
+
+	// The library can't send SASL binds, so the EXTERNAL bind (and StartTLS
+	// before it) is done before the connection is handed over to it.
+	if l.bindMethod() == ldapBindExternal {
+		if l.StartTLS {
+			netConn, err = ldapStartTLS(netConn, tlsConfig, l.timeout())
+			if err != nil {
+				return nil, fmt.Errorf("StartTLS failed: %v", err)
+			}
+			isTLS = true
+		}
+
+		err = ldapExternalBind(netConn, l.timeout())
+		if err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("SASL EXTERNAL bind failed: %v", err)
+		}
+	}
+
+	c := ldap.NewConn(netConn, isTLS)
+	c.SetTimeout(l.timeout())
+	c.Start()
+
+	if l.StartTLS && !isTLS {
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("StartTLS failed: %v", err)
+		}
+	}
+
+	if l.bindMethod() == ldapBindSimple {
+		err = c.Bind(l.BindUser, l.BindPassword)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
-func (l *LDAP) connect() error {
-	conn, err := l.cfg.connect()
+// How connections to LDAP are authenticated, see bindMethod.
+const (
+	ldapBindAnonymous = "anonymous"
+	ldapBindSimple    = "simple"
+	ldapBindExternal  = "external"
+)
+
+// bindMethod returns how connections are authenticated: with a simple bind
+// if a bind user is configured, with a SASL EXTERNAL bind (i.e. as the
+// subject of the client certificate) if only a client certificate is, and
+// anonymously otherwise.
+func (l *LDAPConfig) bindMethod() string {
+	switch {
+	case l.BindUser != "":
+		return ldapBindSimple
+	case l.CertFile != "":
+		return ldapBindExternal
+	default:
+		return ldapBindAnonymous
+	}
+}
+
+// ldapStartTLS upgrades a plain connection to an LDAP server to TLS.
+func ldapStartTLS(
+	conn net.Conn,
+	config *tls.Config,
+	timeout time.Duration,
+) (net.Conn, error) {
+	req := ber.Encode(
+		ber.ClassApplication,
+		ber.TypeConstructed,
+		ldap.ApplicationExtendedRequest,
+		nil,
+		"Start TLS",
+	)
+	req.AppendChild(ber.NewString(
+		ber.ClassContext,
+		ber.TypePrimitive,
+		0,
+		"1.3.6.1.4.1.1466.20037",
+		"TLS Extended Command",
+	))
+
+	err := ldapExchange(conn, 1, req, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// ldapExternalBind authenticates the connection as the subject of the client
+// certificate presented during the TLS handshake.
+func ldapExternalBind(conn net.Conn, timeout time.Duration) error {
+	req := ber.Encode(
+		ber.ClassApplication,
+		ber.TypeConstructed,
+		ldap.ApplicationBindRequest,
+		nil,
+		"Bind Request",
+	)
+	req.AppendChild(ber.NewInteger(
+		ber.ClassUniversal,
+		ber.TypePrimitive,
+		ber.TagInteger,
+		3,
+		"Version",
+	))
+	req.AppendChild(ber.NewString(
+		ber.ClassUniversal,
+		ber.TypePrimitive,
+		ber.TagOctetString,
+		"",
+		"User Name",
+	))
+
+	sasl := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "SASL")
+	sasl.AppendChild(ber.NewString(
+		ber.ClassUniversal,
+		ber.TypePrimitive,
+		ber.TagOctetString,
+		"EXTERNAL",
+		"Mechanism",
+	))
+	req.AppendChild(sasl)
+
+	return ldapExchange(conn, 2, req, timeout)
+}
+
+// ldapExchange sends a single request on a connection that isn't managed by
+// ldap.Conn (yet) and waits for its result.
+func ldapExchange(
+	conn net.Conn,
+	id int64,
+	req *ber.Packet,
+	timeout time.Duration,
+) error {
+	packet := ber.Encode(
+		ber.ClassUniversal,
+		ber.TypeConstructed,
+		ber.TagSequence,
+		nil,
+		"LDAP Request",
+	)
+	packet.AppendChild(ber.NewInteger(
+		ber.ClassUniversal,
+		ber.TypePrimitive,
+		ber.TagInteger,
+		id,
+		"MessageID",
+	))
+	packet.AppendChild(req)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err := conn.Write(packet.Bytes())
 	if err != nil {
 		return err
 	}
 
-	l.conn = conn
-	return nil
+	resp, err := ber.ReadPacket(conn)
+	if err != nil {
+		return err
+	}
+
+	return ldap.GetLDAPError(resp)
 }
 
-// GroupMembers returns the members of group `group` as a slice of User
-// instances. Implements the Service interface.
-func (l LDAP) GroupMembers(group string) ([]User, error) {
-	l.connect()
-	defer l.close()
+// tlsConfig builds the TLS configuration used for both LDAPS and StartTLS
+// connections to `host`.
+func (l *LDAPConfig) tlsConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: l.SkipVerify,
+		ServerName:         l.ServerName,
+	}
 
-	var attrs []string
-	for _, attr := range []string{l.cfg.UserIDAttribute} {
-		if attr != "" {
-			attrs = append(attrs, attr)
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	if l.CAFile != "" {
+		pem, err := ioutil.ReadFile(l.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read LDAP CA file: %v", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf(
+				"no certificates found in LDAP CA file %s",
+				l.CAFile,
+			)
+		}
+	}
+
+	if l.CertFile != "" || l.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load LDAP client certificate: %v", err)
 		}
+
+		cfg.Certificates = []tls.Certificate{cert}
 	}
 
-	if len(attrs) < 1 {
+	return cfg, nil
+}
+
+// connection returns the connection to the LDAP server. The connection is
+// established (and bound) on first use and then reused for the rest of the
+// run, so that the cost of connecting is only paid once. The connection is
+// shared by mappings running concurrently.
+func (l *LDAP) connection() (*ldap.Conn, error) {
+	ldapConnMutex.Lock()
+	defer ldapConnMutex.Unlock()
+
+	if l.conn != nil && !l.conn.IsClosing() {
+		return l.conn, nil
+	}
+
+	l.closeConn()
+
+	conn, err := l.cfg.connect()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to LDAP (%s): %v", l.name, err)
+	}
+
+	l.conn = conn
+	return conn, nil
+}
+
+// GroupMembers returns the members of group `group` as a slice of User
+// instances. Implements the Service interface.
+func (l *LDAP) GroupMembers(group string) ([]User, error) {
+	if l.cfg.UserIDAttribute == "" {
 		return nil,
 			errors.New("LDAP config didn't provide any attributes to look up")
 	}
 
-	if l.conn == nil {
-		return nil,
-			errors.New("no LDAP connection")
+	grp, err := l.findGroup(group)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get the DN of the group.
-	group, err := l.findGroup(group)
+	var entries []*ldap.Entry
+
+	switch l.cfg.membership() {
+	case ldapMembershipMemberOf:
+		entries, err = l.membersByMemberOf(grp)
+	case ldapMembershipMember:
+		entries, err = l.membersByDN(grp)
+	case ldapMembershipMemberUID:
+		entries, err = l.membersByUID(grp)
+	default:
+		err = fmt.Errorf("unknown membership setting `%s`", l.cfg.Membership)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	filter := fmt.Sprintf(
-		"(&(objectClass=%s)(%s=%s))",
-		l.cfg.UserClass,
-		l.cfg.SearchAttribute,
-		ldap.EscapeFilter(group),
-	)
+	return l.usersFromEntries(entries)
+}
+
+// usersFromEntries turns user entries into User instances.
+func (l *LDAP) usersFromEntries(entries []*ldap.Entry) ([]User, error) {
+	var members []User
 
-	result, err := l.conn.Search(&ldap.SearchRequest{
+	for _, e := range entries {
+		member := LDAPIdentity{}
+		member.id = e.GetAttributeValue(l.cfg.UserIDAttribute)
+		if member.id == "" {
+			return nil, fmt.Errorf(
+				"Failed to get user ID (%s) for %s",
+				l.cfg.UserIDAttribute,
+				e.DN,
+			)
+		}
+
+		u := newUser()
+		u.addIdentity(l.name, member)
+
+		members = append(
+			members,
+			u,
+		)
+	}
+
+	return members, nil
+}
+
+// membersByMemberOf looks up the members of a group by searching for users
+// that reference it in their SearchAttribute (e.g. `memberOf`).
+func (l *LDAP) membersByMemberOf(group *ldap.Entry) ([]*ldap.Entry, error) {
+	var filter string
+
+	switch l.cfg.NestedGroups {
+	case "":
+		filter = fmt.Sprintf(
+			"(&(objectClass=%s)(%s=%s))",
+			l.cfg.UserClass,
+			l.cfg.SearchAttribute,
+			ldap.EscapeFilter(group.DN),
+		)
+	case "in_chain":
+		filter = fmt.Sprintf(
+			"(&(objectClass=%s)(%s:%s:=%s))",
+			l.cfg.UserClass,
+			l.cfg.SearchAttribute,
+			ldapMatchingRuleInChain,
+			ldap.EscapeFilter(group.DN),
+		)
+	case "recursive":
+		groups, err := l.nestedGroups(group)
+		if err != nil {
+			return nil, err
+		}
+
+		var b strings.Builder
+		for _, g := range groups {
+			b.WriteString(fmt.Sprintf(
+				"(%s=%s)",
+				l.cfg.SearchAttribute,
+				ldap.EscapeFilter(g.DN),
+			))
+		}
+
+		filter = fmt.Sprintf(
+			"(&(objectClass=%s)(|%s))",
+			l.cfg.UserClass,
+			b.String(),
+		)
+	default:
+		return nil, fmt.Errorf(
+			"unknown nested_groups setting `%s`",
+			l.cfg.NestedGroups,
+		)
+	}
+
+	result, err := l.search(&ldap.SearchRequest{
 		BaseDN:       l.cfg.UserBaseDN,
 		Filter:       filter,
 		Scope:        2,
 		DerefAliases: 1,
-		Attributes:   attrs,
+		Attributes:   []string{l.cfg.UserIDAttribute},
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	var members []User
+	return result.Entries, nil
+}
 
-	for _, e := range result.Entries {
-		member := LDAPIdentity{}
-		if l.cfg.UserIDAttribute != "" {
-			member.id = e.GetAttributeValue(l.cfg.UserIDAttribute)
-			if member.id == "" {
-				return nil, fmt.Errorf(
-					"Failed to get user ID (%s) for %s",
-					l.cfg.UserIDAttribute,
-					e.DN,
+// membersByDN looks up the members of a group by reading the DNs of its
+// members from the group itself (e.g. `member` or `uniqueMember`).
+func (l *LDAP) membersByDN(group *ldap.Entry) ([]*ldap.Entry, error) {
+	groups := []*ldap.Entry{group}
+
+	switch l.cfg.NestedGroups {
+	case "":
+	case "recursive":
+		var err error
+		groups, err = l.nestedGroups(group)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf(
+			"nested_groups setting `%s` can't be used with membership `%s`",
+			l.cfg.NestedGroups,
+			ldapMembershipMember,
+		)
+	}
+
+	isGroup := make(map[string]bool)
+	for _, g := range groups {
+		isGroup[strings.ToLower(g.DN)] = true
+	}
+
+	seen := make(map[string]bool)
+	var memberDNs []string
+
+	for _, g := range groups {
+		dns, err := l.memberValues(g)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dn := range dns {
+			if isGroup[strings.ToLower(dn)] || seen[strings.ToLower(dn)] {
+				continue
+			}
+			seen[strings.ToLower(dn)] = true
+
+			memberDNs = append(memberDNs, dn)
+		}
+	}
+
+	return l.usersByDN(memberDNs)
+}
+
+// usersByDN reads the user entries with the given DNs. Users under
+// `user_base_dn` are looked up in batches, by the first component of their
+// DN (e.g. `cn`); the rest are read one at a time. DNs that don't exist or
+// aren't users are skipped.
+func (l *LDAP) usersByDN(dns []string) ([]*ldap.Entry, error) {
+	baseDN, err := ldap.ParseDN(l.cfg.UserBaseDN)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"invalid user_base_dn `%s`: %s",
+			l.cfg.UserBaseDN,
+			err,
+		)
+	}
+
+	// The DNs to look up in batches, grouped by the attribute of their first
+	// component.
+	byAttr := make(map[string][]*ldap.DN)
+	var attrs []string
+
+	for _, dn := range dns {
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil || !baseDN.AncestorOf(parsed) ||
+			len(parsed.RDNs[0].Attributes) != 1 {
+			continue
+		}
+
+		attr := strings.ToLower(parsed.RDNs[0].Attributes[0].Type)
+		if _, ok := byAttr[attr]; !ok {
+			attrs = append(attrs, attr)
+		}
+		byAttr[attr] = append(byAttr[attr], parsed)
+	}
+
+	found := make(map[string]*ldap.Entry)
+	batched := make(map[string]bool)
+
+	for _, attr := range attrs {
+		parsed := byAttr[attr]
+
+		for start := 0; start < len(parsed); start += ldapUIDBatchSize {
+			end := start + ldapUIDBatchSize
+			if end > len(parsed) {
+				end = len(parsed)
+			}
+
+			var b strings.Builder
+			for _, dn := range parsed[start:end] {
+				batched[dnKey(dn)] = true
+				b.WriteString(fmt.Sprintf(
+					"(%s=%s)",
+					attr,
+					ldap.EscapeFilter(dn.RDNs[0].Attributes[0].Value),
+				))
+			}
+
+			result, err := l.search(&ldap.SearchRequest{
+				BaseDN: l.cfg.UserBaseDN,
+				Filter: fmt.Sprintf(
+					"(&(objectClass=%s)(|%s))",
+					l.cfg.UserClass,
+					b.String(),
+				),
+				Scope:        2,
+				DerefAliases: 1,
+				Attributes:   []string{l.cfg.UserIDAttribute},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error looking up group members: %s", err)
+			}
+
+			// Users with the same name in other OUs match the filter too.
+			for _, e := range result.Entries {
+				parsed, err := ldap.ParseDN(e.DN)
+				if err != nil {
+					continue
+				}
+
+				found[dnKey(parsed)] = e
+			}
+		}
+	}
+
+	var result []*ldap.Entry
+
+	for _, dn := range dns {
+		var entry *ldap.Entry
+
+		parsed, err := ldap.ParseDN(dn)
+		if err == nil && batched[dnKey(parsed)] {
+			entry = found[dnKey(parsed)]
+			if entry == nil {
+				logger.Warningf(
+					"Group member %s doesn't exist or isn't a user - skipping.",
+					dn,
 				)
 			}
+		} else {
+			entry, err = l.userByDN(dn)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		u := newUser()
-		u.addIdentity("ldap", member)
+		if entry != nil {
+			result = append(result, entry)
+		}
+	}
 
-		members = append(
-			members,
-			u,
+	return result, nil
+}
+
+// dnKey returns a key identifying a DN regardless of its case and spacing.
+func dnKey(dn *ldap.DN) string {
+	var rdns []string
+	for _, rdn := range dn.RDNs {
+		var attrs []string
+		for _, a := range rdn.Attributes {
+			attrs = append(attrs, strings.ToLower(a.Type+"="+a.Value))
+		}
+		sort.Strings(attrs)
+
+		rdns = append(rdns, strings.Join(attrs, "+"))
+	}
+
+	return strings.Join(rdns, ",")
+}
+
+// userByDN reads the user entry with the given DN. Returns nil if the entry
+// doesn't exist or isn't a user (e.g. it's a group).
+func (l *LDAP) userByDN(dn string) (*ldap.Entry, error) {
+	result, err := l.search(&ldap.SearchRequest{
+		BaseDN:       dn,
+		Filter:       fmt.Sprintf("(objectClass=%s)", l.cfg.UserClass),
+		Scope:        0,
+		DerefAliases: 1,
+		Attributes:   []string{l.cfg.UserIDAttribute},
+	})
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		logger.Warningf("Group member %s doesn't exist - skipping.", dn)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up group member %s: %s", dn, err)
+	}
+
+	if len(result.Entries) < 1 {
+		return nil, nil
+	}
+
+	return result.Entries[0], nil
+}
+
+// The number of users looked up in a single search by membersByUID and
+// usersByDN.
+const ldapUIDBatchSize = 50
+
+// membersByUID looks up the members of a group by reading the user IDs of its
+// members from the group itself (e.g. `memberUid` of posixGroup).
+func (l *LDAP) membersByUID(group *ldap.Entry) ([]*ldap.Entry, error) {
+	if l.cfg.NestedGroups != "" {
+		return nil, fmt.Errorf(
+			"nested groups can't be used with membership `%s`",
+			ldapMembershipMemberUID,
 		)
 	}
 
-	return members, nil
+	uids, err := l.memberValues(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*ldap.Entry
+
+	for start := 0; start < len(uids); start += ldapUIDBatchSize {
+		end := start + ldapUIDBatchSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+
+		var b strings.Builder
+		for _, uid := range uids[start:end] {
+			b.WriteString(fmt.Sprintf(
+				"(%s=%s)",
+				l.cfg.memberUIDAttribute(),
+				ldap.EscapeFilter(uid),
+			))
+		}
+
+		found, err := l.search(&ldap.SearchRequest{
+			BaseDN: l.cfg.UserBaseDN,
+			Filter: fmt.Sprintf(
+				"(&(objectClass=%s)(|%s))",
+				l.cfg.UserClass,
+				b.String(),
+			),
+			Scope:        2,
+			DerefAliases: 1,
+			Attributes:   []string{l.cfg.UserIDAttribute},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, found.Entries...)
+	}
+
+	return result, nil
+}
+
+// nestedGroups returns the entry of `group` and the entries of all the groups
+// nested in it, however deep. Cycles in group membership are tolerated.
+func (l *LDAP) nestedGroups(group *ldap.Entry) ([]*ldap.Entry, error) {
+	allGroups, err := l.allGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	visited := map[string]bool{strings.ToLower(group.DN): true}
+	groups := []*ldap.Entry{group}
+
+	for i := 0; i < len(groups); i++ {
+		dns, err := l.memberValues(groups[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dn := range dns {
+			nested, isGroup := allGroups[strings.ToLower(dn)]
+			if !isGroup {
+				continue
+			}
+
+			if visited[strings.ToLower(dn)] {
+				logger.Infof(
+					"Group %s visited more than once while resolving %s.",
+					dn,
+					group.DN,
+				)
+				continue
+			}
+
+			visited[strings.ToLower(dn)] = true
+			groups = append(groups, nested)
+		}
+	}
+
+	return groups, nil
+}
+
+// ldapGroupCache holds the groups (and their members) listed by allGroups
+// during a run, keyed by service and group settings. Groups are dropped from the cache when
+// changes are committed to any of them.
+var ldapGroupCache = make(map[string]map[string]*ldap.Entry)
+var ldapGroupCacheMutex sync.Mutex
+
+// allGroups returns all the groups under `group_base_dn`, keyed by their
+// lowercased DN, from the cache if they were listed before.
+func (l *LDAP) allGroups() (map[string]*ldap.Entry, error) {
+	ldapGroupCacheMutex.Lock()
+	groups, ok := ldapGroupCache[l.groupCacheKey()]
+	ldapGroupCacheMutex.Unlock()
+	if ok {
+		return groups, nil
+	}
+
+	result, err := l.search(&ldap.SearchRequest{
+		BaseDN:       l.cfg.GroupBaseDN,
+		Filter:       fmt.Sprintf("(objectClass=%s)", l.cfg.groupClass()),
+		Scope:        2,
+		DerefAliases: 1,
+		Attributes:   []string{l.cfg.groupMemberAttribute()},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error looking up nested groups: %s", err)
+	}
+
+	// DNs are case insensitive.
+	groups = make(map[string]*ldap.Entry)
+	for _, e := range result.Entries {
+		groups[strings.ToLower(e.DN)] = e
+	}
+
+	ldapGroupCacheMutex.Lock()
+	ldapGroupCache[l.groupCacheKey()] = groups
+	ldapGroupCacheMutex.Unlock()
+
+	return groups, nil
+}
+
+// invalidateGroups drops the groups listed by allGroups from the cache.
+func (l *LDAP) invalidateGroups() {
+	ldapGroupCacheMutex.Lock()
+	defer ldapGroupCacheMutex.Unlock()
+
+	delete(ldapGroupCache, l.groupCacheKey())
+}
+
+func (l *LDAP) groupCacheKey() string {
+	return strings.Join([]string{
+		l.name,
+		l.cfg.GroupBaseDN,
+		l.cfg.groupClass(),
+		l.cfg.groupMemberAttribute(),
+	}, "\x00")
+}
+
+// memberValues returns all the values of the member attribute of a group.
+// Active Directory returns the members of large groups in ranges (e.g.
+// `member;range=0-1499`), the rest of which are read with further searches.
+func (l *LDAP) memberValues(group *ldap.Entry) ([]string, error) {
+	attr := l.cfg.groupMemberAttribute()
+
+	values, next, err := rangedValues(group, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	for next != "" {
+		result, err := l.search(&ldap.SearchRequest{
+			BaseDN:       group.DN,
+			Filter:       "(objectClass=*)",
+			Scope:        0,
+			DerefAliases: 1,
+			Attributes:   []string{next},
+		})
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error reading the members of %s: %s",
+				group.DN,
+				err,
+			)
+		}
+
+		if len(result.Entries) != 1 {
+			return nil, fmt.Errorf("group %s disappeared", group.DN)
+		}
+
+		var more []string
+		more, next, err = rangedValues(result.Entries[0], attr)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(more) == 0 && next != "" {
+			return nil, fmt.Errorf(
+				"no progress reading the members of %s (%s)",
+				group.DN,
+				next,
+			)
+		}
+
+		values = append(values, more...)
+	}
+
+	return values, nil
+}
+
+// rangedValues returns the values of `attr` in the entry. If only a range of
+// the values was returned, the attribute to request for the next range
+// (e.g. `member;range=1500-*`) is returned as well.
+func rangedValues(entry *ldap.Entry, attr string) ([]string, string, error) {
+	prefix := strings.ToLower(attr) + ";range="
+
+	for _, a := range entry.Attributes {
+		if strings.EqualFold(a.Name, attr) {
+			return a.Values, "", nil
+		}
+
+		if !strings.HasPrefix(strings.ToLower(a.Name), prefix) {
+			continue
+		}
+
+		bounds := strings.SplitN(a.Name[len(prefix):], "-", 2)
+		if len(bounds) != 2 {
+			return nil, "", fmt.Errorf(
+				"invalid range `%s` of %s",
+				a.Name,
+				entry.DN,
+			)
+		}
+
+		// The last range ends with `*`.
+		if bounds[1] == "*" {
+			return a.Values, "", nil
+		}
+
+		end, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, "", fmt.Errorf(
+				"invalid range `%s` of %s",
+				a.Name,
+				entry.DN,
+			)
+		}
+
+		return a.Values, fmt.Sprintf("%s;range=%d-*", attr, end+1), nil
+	}
+
+	return nil, "", nil
+}
+
+// search runs a paged search, so that results aren't cut off by the size
+// limit of the server (1000 entries by default in Active Directory).
+// Incomplete results are returned as an LDAPPartialResultError, since a
+// truncated member list would otherwise be synced as a bunch of removals.
+func (l *LDAP) search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	conn, err := l.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	// The paging control gets added to (and updated in) the request.
+	controls := req.Controls
+
+	result, err := conn.SearchWithPaging(req, l.cfg.pageSize())
+
+	// The server (or something in between) may have dropped the connection
+	// since it was last used. Reconnect and retry once.
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		logger.Warningf("Lost the connection to LDAP (%s): %v", l.name, err)
+		l.dropConnection(conn)
+
+		conn, err = l.connection()
+		if err != nil {
+			return nil, err
+		}
+
+		req.Controls = controls
+		result, err = conn.SearchWithPaging(req, l.cfg.pageSize())
+	}
+
+	if err != nil {
+		if isLDAPPartialResult(err) {
+			return nil, newLDAPPartialResultError(req, err)
+		}
+
+		return nil, err
+	}
+
+	return result, nil
 }
 
-// Returns the DN of an LDAP group or an error if not found.
-func (l *LDAP) findGroup(g string) (string, error) {
-	if l.conn == nil {
-		l.connect()
-		defer l.close()
+func isLDAPPartialResult(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultAdminLimitExceeded)
+}
+
+// Implement Target for LDAP.
+
+func (l *LDAP) acquireIdentity(user *User) (Identity, error) {
+	// Users from (other) directories are matched by their user ID.
+	ldapIdentity, ok := user.findIdentity(func(_ string, i Identity) bool {
+		_, isLDAP := i.(LDAPIdentity)
+		return isLDAP
+	})
+	if ok {
+		return l.identityFromUID(ldapIdentity.uniqueID())
+	}
+
+	// GitHub users are matched by the SAML identity linked to them, which
+	// is what GitHub matches LDAP users by in the other direction.
+	var ghService *GitHub
+	ghIdentity, ok := user.findIdentity(func(svc string, i Identity) bool {
+		_, isGitHub := i.(GitHubIdentity)
+		if !isGitHub {
+			return false
+		}
+
+		other, err := SvcFromString(svc)
+		if err != nil {
+			return false
+		}
+
+		ghService, isGitHub = other.(*GitHub)
+		return isGitHub
+	})
+	if ok {
+		nameID, err := ghService.samlNameID(ghIdentity.userID())
+		if err != nil {
+			return nil, err
+		}
+
+		return l.identityFromUID(nameID)
+	}
+
+	emailIdentity, ok := user.findIdentity(func(_ string, i Identity) bool {
+		_, isEmail := i.(EmailIdentity)
+		return isEmail
+	})
+	if ok {
+		entry, err := l.findUserBy(l.cfg.emailAttribute(), emailIdentity.userID())
+		if err != nil {
+			return nil, err
+		}
+
+		return LDAPIdentity{id: entry.GetAttributeValue(l.cfg.UserIDAttribute)}, nil
 	}
 
+	return nil, fmt.Errorf(
+		"couldn't acquire ldap identity for user:\n%v",
+		user,
+	)
+}
+
+// identityFromUID looks up the user with the given value of the configured
+// user ID attribute.
+func (l *LDAP) identityFromUID(uid string) (Identity, error) {
+	entry, err := l.findUser(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return LDAPIdentity{id: entry.GetAttributeValue(l.cfg.UserIDAttribute)}, nil
+}
+
+// identityFor returns the identity of the user with the given value of the
+// configured user ID attribute, without checking that the user exists.
+func (l *LDAP) identityFor(uid string) Identity {
+	return LDAPIdentity{id: uid}
+}
+
+func (l *LDAP) AddMembers(group string, users []User) ([]ChangeResult, error) {
+	return l.modifyMembers(group, users, true)
+}
+
+func (l *LDAP) RemoveMembers(group string, users []User) ([]ChangeResult, error) {
+	return l.modifyMembers(group, users, false)
+}
+
+// modifyMembers adds users to (or removes them from) the member attribute of
+// `group`. Users are modified one at a time, so that a single user who's
+// already a member (or no longer one) doesn't fail the whole batch.
+func (l *LDAP) modifyMembers(group string, users []User, add bool) ([]ChangeResult, error) {
+	grp, err := l.findGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := l.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	defer l.invalidateGroups()
+
+	var results []ChangeResult
+
+	for _, user := range users {
+		identity, err := user.getIdentity(l.name)
+		if err != nil {
+			switch err.(type) {
+			case FatalError:
+				return results, err
+			default:
+				results = append(results, changeFailed(user, err))
+				continue
+			}
+		}
+
+		value, err := l.memberValue(identity.uniqueID())
+		if err != nil {
+			results = append(results, changeFailed(user, err))
+			continue
+		}
+
+		req := ldap.NewModifyRequest(grp.DN, nil)
+		if add {
+			req.Add(l.cfg.groupMemberAttribute(), []string{value})
+		} else {
+			req.Delete(l.cfg.groupMemberAttribute(), []string{value})
+		}
+
+		err = conn.Modify(req)
+		if err != nil {
+			results = append(
+				results,
+				changeFailed(user, fmt.Errorf("failed to modify %s: %v", grp.DN, err)),
+			)
+			continue
+		}
+
+		results = append(results, changeCommitted(user))
+	}
+
+	return results, nil
+}
+
+// memberValue returns the value identifying a user in the member attribute of
+// groups - their user ID for posixGroup-like groups and their DN otherwise.
+func (l *LDAP) memberValue(uid string) (string, error) {
+	entry, err := l.findUser(uid)
+	if err != nil {
+		return "", err
+	}
+
+	if l.cfg.membership() == ldapMembershipMemberUID {
+		value := entry.GetAttributeValue(l.cfg.memberUIDAttribute())
+		if value == "" {
+			return "", fmt.Errorf(
+				"Failed to get member UID (%s) for %s",
+				l.cfg.memberUIDAttribute(),
+				entry.DN,
+			)
+		}
+
+		return value, nil
+	}
+
+	return entry.DN, nil
+}
+
+// findUser returns the entry of the user with the given value of the
+// configured user ID attribute.
+func (l *LDAP) findUser(uid string) (*ldap.Entry, error) {
+	return l.findUserBy(l.cfg.UserIDAttribute, uid)
+}
+
+// findUserBy returns the entry of the user with the given value of `attr`.
+func (l *LDAP) findUserBy(attr, value string) (*ldap.Entry, error) {
+	result, err := l.search(&ldap.SearchRequest{
+		BaseDN: l.cfg.UserBaseDN,
+		Filter: fmt.Sprintf(
+			"(&(objectClass=%s)(%s=%s))",
+			l.cfg.UserClass,
+			attr,
+			ldap.EscapeFilter(value),
+		),
+		Scope:        2,
+		DerefAliases: 1,
+		Attributes: []string{
+			l.cfg.UserIDAttribute,
+			l.cfg.memberUIDAttribute(),
+			l.cfg.emailAttribute(),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error looking up user %s: %s", value, err)
+	}
+
+	if len(result.Entries) < 1 {
+		return nil, fmt.Errorf("LDAP user `%s` not found", value)
+	} else if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("multiple LDAP users found for `%s`", value)
+	}
+
+	return result.Entries[0], nil
+}
+
+// ldapUserDirectory is implemented by LDAP, for targets that find LDAP users
+// by more than their user ID.
+type ldapUserDirectory interface {
+	lookUpUser(uid string) (ldapUser, error)
+}
+
+// ldapUser is what's known about an LDAP user besides their user ID.
+type ldapUser struct {
+	dn    string
+	email string
+}
+
+// lookUpUser returns the DN and email of the user with the given user ID.
+func (l *LDAP) lookUpUser(uid string) (ldapUser, error) {
+	entry, err := l.findUser(uid)
+	if err != nil {
+		return ldapUser{}, err
+	}
+
+	return ldapUser{
+		dn:    entry.DN,
+		email: entry.GetAttributeValue(l.cfg.emailAttribute()),
+	}, nil
+}
+
+// ListGroups returns the names of all the groups under GroupBaseDN.
+// Implements the GroupLister interface.
+func (l *LDAP) ListGroups() ([]string, error) {
+	result, err := l.search(&ldap.SearchRequest{
+		BaseDN:       l.cfg.GroupBaseDN,
+		Filter:       fmt.Sprintf("(objectClass=%s)", l.cfg.groupClass()),
+		Scope:        2,
+		DerefAliases: 1,
+		Attributes:   []string{l.cfg.groupNameAttribute()},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing groups: %s", err)
+	}
+
+	var groups []string
+	for _, e := range result.Entries {
+		if name := e.GetAttributeValue(l.cfg.groupNameAttribute()); name != "" {
+			groups = append(groups, name)
+		}
+	}
+
+	return groups, nil
+}
+
+// Returns the entry of an LDAP group or an error if not found. The entry
+// includes the group's member attribute.
+func (l *LDAP) findGroup(g string) (*ldap.Entry, error) {
 	filter := fmt.Sprintf(
-		"(&(objectClass=group)(cn=%s))",
+		"(&(objectClass=%s)(%s=%s))",
+		l.cfg.groupClass(),
+		l.cfg.groupNameAttribute(),
 		ldap.EscapeFilter(g),
 	)
 
-	result, err := l.conn.Search(&ldap.SearchRequest{
+	result, err := l.search(&ldap.SearchRequest{
 		BaseDN:       l.cfg.GroupBaseDN,
 		Filter:       filter,
 		Scope:        2,
 		DerefAliases: 1,
+		Attributes:   []string{l.cfg.groupMemberAttribute()},
 	})
 	if err != nil {
-		return "", fmt.Errorf("error looking up group %s: %s", g, err)
+		return nil, fmt.Errorf("error looking up group %s: %s", g, err)
 	}
 
 	if len(result.Entries) < 1 {
-		return "", fmt.Errorf("group `%s` not found", g)
+		return nil, fmt.Errorf("group `%s` not found", g)
 	} else if len(result.Entries) > 1 {
-		return "", fmt.Errorf("multiple groups found for `%s`", g)
+		return nil, fmt.Errorf("multiple groups found for `%s`", g)
 	}
 
-	return result.Entries[0].DN, nil
+	return result.Entries[0], nil
 }
 
+// close closes the connection to the LDAP server, if any. A new one is
+// established if the service is used again.
 func (l *LDAP) close() {
+	ldapConnMutex.Lock()
+	defer ldapConnMutex.Unlock()
+
+	l.closeConn()
+}
+
+// dropConnection closes `conn` if it's still the connection in use, so that
+// a new one is established. Another mapping may have replaced it already.
+func (l *LDAP) dropConnection(conn *ldap.Conn) {
+	ldapConnMutex.Lock()
+	defer ldapConnMutex.Unlock()
+
+	if l.conn == conn {
+		l.closeConn()
+	}
+}
+
+// closeConn closes the connection. ldapConnMutex must be held.
+func (l *LDAP) closeConn() {
 	if l.conn != nil {
 		l.conn.Close()
 		l.conn = nil
 	}
 }
+
+type LDAPPartialResultError struct {
+	baseDN string
+	filter string
+	source error
+}
+
+func newLDAPPartialResultError(
+	req *ldap.SearchRequest,
+	source error,
+) LDAPPartialResultError {
+	return LDAPPartialResultError{
+		baseDN: req.BaseDN,
+		filter: req.Filter,
+		source: source,
+	}
+}
+
+func (e LDAPPartialResultError) Error() string {
+	return fmt.Sprintf(
+		"incomplete LDAP search results for %s under %s (%v); "+
+			"try lowering page_size",
+		e.filter,
+		e.baseDN,
+		e.source,
+	)
+}
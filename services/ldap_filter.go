@@ -0,0 +1,86 @@
+package services
+
+// LDAP filters as sources, e.g. `ldap-filter:(department=Platform)`.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/ldap.v3"
+)
+
+// The suffix turning the name of an LDAP service into the name of a service
+// whose "groups" are LDAP filters, e.g. `ldap-filter` or `corp-ldap-filter`.
+const ldapFilterSuffix = "-filter"
+
+// LDAPFilter is a source whose groups are made up of the users matching an
+// LDAP filter, e.g. `(&(department=Platform)(employeeType=FTE))`, rather
+// than of the members of a group. It shares the connection and the config
+// of the LDAP service it wraps.
+type LDAPFilter struct {
+	ldap *LDAP
+}
+
+// newLDAPFilter creates an LDAPFilter running filters against the LDAP
+// service called `name`.
+func newLDAPFilter(name string) (*LDAPFilter, error) {
+	svc, err := SvcFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	l, ok := svc.(*LDAP)
+	if !ok {
+		return nil, fmt.Errorf(
+			"`%s%s` needs `%s` to be an LDAP service",
+			name,
+			ldapFilterSuffix,
+			name,
+		)
+	}
+
+	return &LDAPFilter{ldap: l}, nil
+}
+
+// GroupMembers returns the users under UserBaseDN matching `filter`.
+// Implements the Service interface.
+func (f *LDAPFilter) GroupMembers(filter string) ([]User, error) {
+	return f.ldap.filterMembers(filter)
+}
+
+// filterMembers returns the users matching an LDAP filter.
+func (l *LDAP) filterMembers(filter string) ([]User, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+
+	// Catch mistakes before anything is sent to the server.
+	_, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP filter `%s`: %v", filter, err)
+	}
+
+	if l.cfg.UserIDAttribute == "" {
+		return nil,
+			errors.New("LDAP config didn't provide any attributes to look up")
+	}
+
+	result, err := l.search(&ldap.SearchRequest{
+		BaseDN: l.cfg.UserBaseDN,
+		Filter: fmt.Sprintf(
+			"(&(objectClass=%s)%s)",
+			l.cfg.UserClass,
+			filter,
+		),
+		Scope:        2,
+		DerefAliases: 1,
+		Attributes:   []string{l.cfg.UserIDAttribute},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l.usersFromEntries(result.Entries)
+}
@@ -2,8 +2,17 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,9 +21,12 @@ import (
 	"docker.io/go-docker/api/types/container"
 	"docker.io/go-docker/api/types/network"
 	"github.com/docker/go-connections/nat"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v3"
 )
 
 var client = LDAP{
+	name: "ldap",
 	cfg: LDAPConfig{
 		Port:       389,
 		Server:     "127.0.0.1",
@@ -33,6 +45,7 @@ var client = LDAP{
 }
 
 var sslClient = LDAP{
+	name: "ldap",
 	cfg: LDAPConfig{
 		Port:       636,
 		Server:     "127.0.0.1",
@@ -50,50 +63,634 @@ var sslClient = LDAP{
 	},
 }
 
+var startTLSClient = LDAP{
+	name: "ldap",
+	cfg: LDAPConfig{
+		Port:       389,
+		Server:     "127.0.0.1",
+		StartTLS:   true,
+		SkipVerify: true,
+
+		BindUser:     "cn=admin,dc=planetexpress,dc=com",
+		BindPassword: "GoodNewsEveryone",
+
+		UserBaseDN:      "ou=people,dc=planetexpress,dc=com",
+		GroupBaseDN:     "ou=people,dc=planetexpress,dc=com",
+		UserClass:       "person",
+		SearchAttribute: "memberOf",
+		UserIDAttribute: "uid",
+	},
+}
+
 // Test cases
 
 func TestLDAP(t *testing.T) {
 	ldapTeardown := setupLDAPService(t)
 	defer ldapTeardown(t)
 
-	testClient(t, client)
-	testClient(t, sslClient)
+	testClient(t, &client)
+	testClient(t, &sslClient)
+	testClient(t, &startTLSClient)
+	testNestedGroups(t)
+	testGroupSchemas(t)
+	testPagedSearch(t)
+	testConnectionReuse(t)
+	testWriteMembers(t)
+	testFilterSource(t)
 }
 
-// Helpers
+func TestLDAPTLSConfig(t *testing.T) {
+	key, keyFile := newTestRSAKey()
+	defer os.Remove(keyFile)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap.internal"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	certFile, err := ioutil.TempFile("", "groupsync-cert-*.pem")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(certFile.Name())
+
+	err = pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err != nil {
+		panic(err)
+	}
+	certFile.Close()
+
+	cfg := LDAPConfig{
+		Server:   "10.0.0.1",
+		CAFile:   certFile.Name(),
+		CertFile: certFile.Name(),
+		KeyFile:  keyFile,
+	}
+
+	tlsConfig, err := cfg.tlsConfig("10.0.0.1")
+	if err != nil {
+		panic(err)
+	}
+
+	if tlsConfig.ServerName != "10.0.0.1" {
+		panic("server name should default to the server: " + tlsConfig.ServerName)
+	}
+	if tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 {
+		panic("CA bundle or client certificate not loaded")
+	}
 
-func testClient(t *testing.T, client LDAP) {
-	actualResults, err := client.GroupMembers("ship_crew")
+	cfg.ServerName = "ldap.internal"
+	tlsConfig, err = cfg.tlsConfig("10.0.0.1")
 	if err != nil {
 		panic(err)
 	}
 
-	expectedResults := []User{
-		newUser(),
-		newUser(),
-		newUser(),
+	if tlsConfig.ServerName != "ldap.internal" {
+		panic("server name not overridden: " + tlsConfig.ServerName)
 	}
 
-	expectedResults[0].addIdentity(
-		"ldap",
-		LDAPIdentity{
-			id: "bender",
+	// A key isn't a CA bundle.
+	cfg.CAFile = keyFile
+	_, err = cfg.tlsConfig("10.0.0.1")
+	if err == nil {
+		panic("expected an error for a CA file without certificates")
+	}
+}
+
+func TestLDAPServers(t *testing.T) {
+	cfg := LDAPConfig{
+		Port: 3268,
+		Servers: []string{
+			"dc1.my-org.com",
+			"dc2.my-org.com:389",
+			"ldaps://dc3.my-org.com",
+			"ldap://[::1]:1389",
 		},
+	}
+
+	servers, err := cfg.servers()
+	if err != nil {
+		panic(err)
+	}
+
+	var actual []string
+	for _, s := range servers {
+		actual = append(actual, s.String())
+	}
+
+	expected := []string{
+		"ldap://dc1.my-org.com:3268",
+		"ldap://dc2.my-org.com:389",
+		"ldaps://dc3.my-org.com:636",
+		"ldap://[::1]:1389",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		panic(fmt.Sprintf("expected servers %v, got %v", expected, actual))
+	}
+
+	cfg.ServerSelection = "round_robin"
+	first, _ := cfg.servers()
+	second, _ := cfg.servers()
+	if first[0] == second[0] || first[1] != second[0] {
+		panic(fmt.Sprintf("servers not rotated: %v, then %v", first, second))
+	}
+}
+
+func TestLDAPRangedValues(t *testing.T) {
+	var cases = []struct {
+		attr   string
+		values []string
+		next   string
+	}{
+		{"member", []string{"a", "b"}, ""},
+		{"Member;range=0-1", []string{"a", "b"}, "member;range=2-*"},
+		{"member;range=2-*", []string{"c"}, ""},
+		{"uniqueMember", nil, ""},
+	}
+
+	for _, c := range cases {
+		entry := ldap.NewEntry(
+			"cn=big,ou=groups,dc=my-org,dc=com",
+			map[string][]string{c.attr: {"a", "b"}},
+		)
+		if c.values != nil {
+			entry.Attributes[0].Values = c.values
+		}
+
+		values, next, err := rangedValues(entry, "member")
+		if err != nil {
+			panic(err)
+		}
+
+		if !reflect.DeepEqual(values, c.values) || next != c.next {
+			panic(fmt.Sprintf(
+				"%s: expected %v and `%s`, got %v and `%s`",
+				c.attr, c.values, c.next, values, next,
+			))
+		}
+	}
+
+	entry := ldap.NewEntry(
+		"cn=big,ou=groups,dc=my-org,dc=com",
+		map[string][]string{"member;range=0-oops": {"a"}},
 	)
+	_, _, err := rangedValues(entry, "member")
+	if err == nil {
+		panic("expected an error for an invalid range")
+	}
+}
+
+func TestLDAPDNKey(t *testing.T) {
+	a, err := ldap.ParseDN("CN=Philip J. Fry,OU=People,DC=planetexpress,DC=com")
+	if err != nil {
+		panic(err)
+	}
+
+	b, err := ldap.ParseDN("cn=philip j. fry, ou=people, dc=planetexpress, dc=com")
+	if err != nil {
+		panic(err)
+	}
 
-	expectedResults[1].addIdentity(
-		"ldap",
-		LDAPIdentity{
-			id: "fry",
+	if dnKey(a) != dnKey(b) {
+		panic(fmt.Sprintf("expected equal keys, got %s and %s", dnKey(a), dnKey(b)))
+	}
+}
+
+func TestLDAPBindMethod(t *testing.T) {
+	var cases = []struct {
+		cfg    LDAPConfig
+		method string
+	}{
+		{LDAPConfig{}, ldapBindAnonymous},
+		{LDAPConfig{BindUser: "cn=admin"}, ldapBindSimple},
+		{LDAPConfig{CertFile: "client.pem", KeyFile: "key.pem"}, ldapBindExternal},
+		{
+			LDAPConfig{
+				BindUser: "cn=admin",
+				CertFile: "client.pem",
+				KeyFile:  "key.pem",
+			},
+			ldapBindSimple,
 		},
-	)
+	}
+
+	for _, c := range cases {
+		if method := c.cfg.bindMethod(); method != c.method {
+			panic(fmt.Sprintf(
+				"expected bind method %s for %+v, got %s",
+				c.method,
+				c.cfg,
+				method,
+			))
+		}
+	}
+
+	// A client certificate can't authenticate a plain connection.
+	cfg := LDAPConfig{Server: "127.0.0.1", CertFile: "client.pem"}
+	_, err := cfg.connectTo(ldapServer{host: "127.0.0.1", port: "1"})
+	if err == nil || !strings.Contains(err.Error(), "ssl or start_tls") {
+		panic(fmt.Sprintf("expected a client certificate error, got %v", err))
+	}
+}
+
+func TestLDAPExternalBind(t *testing.T) {
+	codes := []int64{
+		ldap.LDAPResultSuccess,
+		ldap.LDAPResultInvalidCredentials,
+	}
+
+	for _, code := range codes {
+		client, server := net.Pipe()
 
-	expectedResults[2].addIdentity(
-		"ldap",
-		LDAPIdentity{
-			id: "leela",
+		mechanism := make(chan string, 1)
+		go func() {
+			defer server.Close()
+
+			req, err := ber.ReadPacket(server)
+			if err != nil {
+				mechanism <- err.Error()
+				return
+			}
+
+			bind := req.Children[1]
+			if bind.Tag != ldap.ApplicationBindRequest {
+				mechanism <- fmt.Sprintf("unexpected request %d", bind.Tag)
+				return
+			}
+			mechanism <- bind.Children[2].Children[0].Value.(string)
+
+			resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			resp.AppendChild(req.Children[0])
+			result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "")
+			result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+			result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			resp.AppendChild(result)
+
+			server.Write(resp.Bytes())
+		}()
+
+		err := ldapExternalBind(client, time.Second)
+		client.Close()
+
+		if m := <-mechanism; m != "EXTERNAL" {
+			panic(fmt.Sprintf("expected a SASL EXTERNAL bind, got %s", m))
+		}
+
+		if (err == nil) != (code == ldap.LDAPResultSuccess) {
+			panic(fmt.Sprintf("unexpected result of bind with code %d: %v", code, err))
+		}
+	}
+}
+
+func TestLDAPFailover(t *testing.T) {
+	// Grab a port nothing listens on.
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	down.Close()
+
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer up.Close()
+
+	accepted := make(chan bool, 1)
+	go func() {
+		conn, err := up.Accept()
+		if err == nil {
+			accepted <- true
+			conn.Close()
+		}
+	}()
+
+	// Without a bind user, nothing is sent after connecting.
+	cfg := LDAPConfig{
+		Servers: []string{
+			"ldap://" + down.Addr().String(),
+			"ldap://" + up.Addr().String(),
 		},
+		Timeout: time.Second,
+	}
+
+	conn, err := cfg.connect()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		panic("didn't fail over to the second server")
+	}
+}
+
+func testNestedGroups(t *testing.T) {
+	// crew_and_staff contains both test groups, plus a group that contains
+	// crew_and_staff again.
+	teardown := addTestEntries(
+		newTestGroup(
+			"crew_and_staff",
+			"cn=ship_crew,ou=people,dc=planetexpress,dc=com",
+			"cn=admin_staff,ou=people,dc=planetexpress,dc=com",
+			"cn=loop,ou=people,dc=planetexpress,dc=com",
+		),
+		newTestGroup(
+			"loop",
+			"cn=crew_and_staff,ou=people,dc=planetexpress,dc=com",
+		),
+	)
+	defer teardown()
+
+	nested := client
+	nested.cfg.NestedGroups = "recursive"
+
+	assertLDAPMembers(
+		t,
+		&nested,
+		"crew_and_staff",
+		[]string{"bender", "fry", "leela", "professor", "hermes"},
+	)
+
+	// Without nested group resolution, the group has no user members.
+	members, err := client.GroupMembers("crew_and_staff")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(members) != 0 {
+		panic(fmt.Sprintf("expected no direct members, got %v", members))
+	}
+}
+
+func testGroupSchemas(t *testing.T) {
+	unique := ldap.NewAddRequest(
+		"cn=unique_crew,ou=people,dc=planetexpress,dc=com",
+		nil,
+	)
+	unique.Attribute("objectClass", []string{"groupOfUniqueNames", "top"})
+	unique.Attribute("cn", []string{"unique_crew"})
+	unique.Attribute("uniqueMember", []string{
+		"cn=Philip J. Fry,ou=people,dc=planetexpress,dc=com",
+		"cn=Turanga Leela,ou=people,dc=planetexpress,dc=com",
+	})
+
+	posix := ldap.NewAddRequest(
+		"cn=posix_crew,ou=people,dc=planetexpress,dc=com",
+		nil,
+	)
+	posix.Attribute("objectClass", []string{"posixGroup", "top"})
+	posix.Attribute("cn", []string{"posix_crew"})
+	posix.Attribute("gidNumber", []string{"5000"})
+	posix.Attribute("memberUid", []string{"bender", "hermes", "nobody"})
+
+	teardown := addTestEntries(unique, posix)
+	defer teardown()
+
+	uniqueClient := client
+	uniqueClient.cfg.GroupClass = "groupOfUniqueNames"
+	uniqueClient.cfg.Membership = "member"
+	uniqueClient.cfg.GroupMemberAttribute = "uniqueMember"
+
+	assertLDAPMembers(t, &uniqueClient, "unique_crew", []string{"fry", "leela"})
+
+	posixClient := client
+	posixClient.cfg.GroupClass = "posixGroup"
+	posixClient.cfg.Membership = "member_uid"
+
+	assertLDAPMembers(t, &posixClient, "posix_crew", []string{"bender", "hermes"})
+
+	// groupOfNames-style groups, found by name.
+	dnClient := client
+	dnClient.cfg.Membership = "member"
+
+	assertLDAPMembers(t, &dnClient, "ship_crew", []string{"bender", "fry", "leela"})
+}
+
+func testPagedSearch(t *testing.T) {
+	// Make sure members spread over several pages are all found.
+	paged := client
+	paged.cfg.PageSize = 2
+
+	testClient(t, &paged)
+}
+
+func testConnectionReuse(t *testing.T) {
+	c := client
+	c.conn = nil
+	defer c.close()
+
+	testClient(t, &c)
+	conn := c.conn
+	if conn == nil {
+		panic("no LDAP connection was kept after the first search")
+	}
+
+	testClient(t, &c)
+
+	if c.conn != conn {
+		panic("the LDAP connection wasn't reused")
+	}
+
+	// A dropped connection is replaced.
+	conn.Close()
+	testClient(t, &c)
+
+	if c.conn == conn {
+		panic("the closed LDAP connection was reused")
+	}
+}
+
+func testWriteMembers(t *testing.T) {
+	tar := client
+	tar.cfg.Membership = "member"
+
+	hermes := newUser()
+	hermes.addIdentity("ldap", LDAPIdentity{id: "hermes"})
+	fry := newUser()
+	fry.addIdentity("ldap", LDAPIdentity{id: "fry"})
+
+	_, err := tar.AddMembers("ship_crew", []User{hermes})
+	if err != nil {
+		panic(err)
+	}
+	_, err = tar.RemoveMembers("ship_crew", []User{fry})
+	if err != nil {
+		panic(err)
+	}
+
+	assertLDAPMembers(t, &tar, "ship_crew", []string{"bender", "leela", "hermes"})
+
+	// Restore the fixture.
+	tar.AddMembers("ship_crew", []User{fry})
+	tar.RemoveMembers("ship_crew", []User{hermes})
+	assertLDAPMembers(t, &tar, "ship_crew", []string{"bender", "fry", "leela"})
+
+	// posixGroup members are written as user IDs.
+	posix := ldap.NewAddRequest(
+		"cn=posix_writes,ou=people,dc=planetexpress,dc=com",
+		nil,
 	)
+	posix.Attribute("objectClass", []string{"posixGroup", "top"})
+	posix.Attribute("cn", []string{"posix_writes"})
+	posix.Attribute("gidNumber", []string{"5001"})
+
+	teardown := addTestEntries(posix)
+	defer teardown()
+
+	posixTar := client
+	posixTar.cfg.GroupClass = "posixGroup"
+	posixTar.cfg.Membership = "member_uid"
+
+	_, err = posixTar.AddMembers("posix_writes", []User{hermes, fry})
+	if err != nil {
+		panic(err)
+	}
+
+	assertLDAPMembers(t, &posixTar, "posix_writes", []string{"hermes", "fry"})
+}
+
+func testFilterSource(t *testing.T) {
+	members, err := client.filterMembers("(|(uid=fry)(uid=leela))")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(members) != 2 {
+		panic(fmt.Sprintf("expected 2 users matching the filter, got %v", members))
+	}
+
+	// Unparenthesized filters are fine too.
+	members, err = client.filterMembers("uid=bender")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(members) != 1 {
+		panic(fmt.Sprintf("expected 1 user matching the filter, got %v", members))
+	}
+}
+
+func TestLDAPFilterService(t *testing.T) {
+	svc, err := SvcFromString("ldap-filter")
+	if err != nil {
+		panic(err)
+	}
+
+	filter, ok := svc.(*LDAPFilter)
+	if !ok {
+		panic(fmt.Sprintf("expected an LDAPFilter, got %T", svc))
+	}
+
+	ldapSvc, _ := SvcFromString("ldap")
+	if filter.ldap != ldapSvc {
+		panic("the filter service should share the LDAP service")
+	}
+
+	// Invalid filters are caught before connecting.
+	_, err = filter.GroupMembers("(&(department=Platform)")
+	if err == nil || !strings.Contains(err.Error(), "invalid LDAP filter") {
+		panic(fmt.Sprintf("expected an invalid filter error, got %v", err))
+	}
+
+	_, err = SvcFromString("mockservice-filter")
+	if err == nil {
+		panic("filters should only be supported for LDAP services")
+	}
+}
+
+func TestLDAPConnectionError(t *testing.T) {
+	// Grab a port nothing listens on.
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	down.Close()
+
+	l := NewLDAP("ldap", LDAPConfig{
+		Servers:         []string{"ldap://" + down.Addr().String()},
+		UserIDAttribute: "uid",
+	})
+
+	_, err = l.GroupMembers("ship_crew")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		panic(fmt.Sprintf("the connection error wasn't propagated: %v", err))
+	}
+}
+
+// Helpers
+
+func testClient(t *testing.T, client *LDAP) {
+	assertLDAPMembers(t, client, "ship_crew", []string{"bender", "fry", "leela"})
+}
+
+// newTestGroup creates a request adding a group shaped like the ones in the
+// test-openldap fixture.
+func newTestGroup(name string, members ...string) *ldap.AddRequest {
+	req := ldap.NewAddRequest(
+		fmt.Sprintf("cn=%s,ou=people,dc=planetexpress,dc=com", name),
+		nil,
+	)
+	req.Attribute("objectClass", []string{"Group", "top"})
+	req.Attribute("groupType", []string{"2147483650"})
+	req.Attribute("cn", []string{name})
+	req.Attribute("member", members)
+
+	return req
+}
+
+// addTestEntries adds entries to the test LDAP server and returns a function
+// removing them again.
+func addTestEntries(entries ...*ldap.AddRequest) func() {
+	conn, err := client.cfg.connect()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, e := range entries {
+		err = conn.Add(e)
+		if err != nil {
+			panic(err)
+		}
+	}
+	client.invalidateGroups()
+
+	return func() {
+		defer conn.Close()
+		defer client.invalidateGroups()
+
+		for _, e := range entries {
+			err := conn.Del(ldap.NewDelRequest(e.DN, nil))
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+func assertLDAPMembers(t *testing.T, client *LDAP, group string, ids []string) {
+	actualResults, err := client.GroupMembers(group)
+	if err != nil {
+		panic(err)
+	}
+
+	var expectedResults []User
+	for _, id := range ids {
+		u := newUser()
+		u.addIdentity("ldap", LDAPIdentity{id: id})
+		expectedResults = append(expectedResults, u)
+	}
 
 	expectedResultsOrig := expectedResults
 
@@ -0,0 +1,80 @@
+package services
+
+import "fmt"
+
+// Limits guard against destructive syncs, e.g. when a broken source returns
+// only a fraction of the expected members. A nil value means no limit.
+type Limits struct {
+	MaxRemovals       *int     `yaml:"max_removals"`
+	MaxRemovalPercent *float64 `yaml:"max_removal_percent"`
+}
+
+// withDefaults returns the limits with any unset values taken from `d`.
+func (l Limits) withDefaults(d Limits) Limits {
+	if l.MaxRemovals == nil {
+		l.MaxRemovals = d.MaxRemovals
+	}
+
+	if l.MaxRemovalPercent == nil {
+		l.MaxRemovalPercent = d.MaxRemovalPercent
+	}
+
+	return l
+}
+
+// check verifies the diff doesn't go over any of the limits.
+func (l Limits) check(diff DiffResult) error {
+	removals := len(diff.Rem)
+
+	if l.MaxRemovals != nil && removals > *l.MaxRemovals {
+		return newLimitExceededError(fmt.Sprintf(
+			"%d removals planned, the limit is %d",
+			removals,
+			*l.MaxRemovals,
+		))
+	}
+
+	if l.MaxRemovalPercent != nil && diff.TargetSize > 0 {
+		percent := float64(removals) / float64(diff.TargetSize) * 100
+		if percent > *l.MaxRemovalPercent {
+			return newLimitExceededError(fmt.Sprintf(
+				"%.1f%% of the target members (%d of %d) would be removed, "+
+					"the limit is %.1f%%",
+				percent,
+				removals,
+				diff.TargetSize,
+				*l.MaxRemovalPercent,
+			))
+		}
+	}
+
+	return nil
+}
+
+// CheckLimits calculates the diff of the mapping and verifies it doesn't go
+// over the limits of the mapping. Limits not set for the mapping are taken
+// from `global`.
+func (m *Mapping) CheckLimits(global Limits) error {
+	diff, err := m.Diff()
+	if err != nil {
+		return err
+	}
+
+	return m.limits.withDefaults(global).check(diff)
+}
+
+// LimitExceededError is returned when committing the changes of a mapping
+// would go over one of its limits.
+type LimitExceededError struct {
+	reason string
+}
+
+func newLimitExceededError(reason string) LimitExceededError {
+	return LimitExceededError{
+		reason: reason,
+	}
+}
+
+func (e LimitExceededError) Error() string {
+	return fmt.Sprintf("safety limit exceeded: %s", e.reason)
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestLimits(t *testing.T) {
+	two := 2
+	twenty := 20.0
+
+	var cases = []struct {
+		mapping  Limits
+		global   Limits
+		rem      uint32
+		tarSize  int
+		exceeded bool
+	}{
+		{Limits{}, Limits{}, 10, 10, false},
+		{Limits{MaxRemovals: &two}, Limits{}, 2, 10, false},
+		{Limits{MaxRemovals: &two}, Limits{}, 3, 10, true},
+		{Limits{}, Limits{MaxRemovals: &two}, 3, 10, true},
+		{Limits{MaxRemovalPercent: &twenty}, Limits{}, 2, 10, false},
+		{Limits{MaxRemovalPercent: &twenty}, Limits{}, 3, 10, true},
+		{Limits{}, Limits{MaxRemovalPercent: &twenty}, 3, 10, true},
+		{Limits{MaxRemovalPercent: &twenty}, Limits{MaxRemovals: &two}, 3, 100, true},
+	}
+
+	for i, c := range cases {
+		m := Mapping{limits: c.mapping}
+		m.diff = &DiffResult{
+			Rem:        buildMockUsers(0, c.rem),
+			TargetSize: c.tarSize,
+		}
+
+		err := m.CheckLimits(c.global)
+		switch err.(type) {
+		case LimitExceededError:
+			if !c.exceeded {
+				panic(fmt.Sprintf("case %d: unexpected error: %v", i, err))
+			}
+		case nil:
+			if c.exceeded {
+				panic(fmt.Sprintf("case %d: limits should have been exceeded", i))
+			}
+		default:
+			panic(fmt.Sprintf("case %d: unexpected error: %v", i, err))
+		}
+	}
+}
+
+func TestYAMLLimits(t *testing.T) {
+	var y YAMLMapping
+
+	err := yaml.Unmarshal([]byte(`
+sources:
+- service: ldap
+  group: my-group
+target:
+  service: github
+  group: my-team
+max_removals: 5
+max_removal_percent: 12.5
+`), &y)
+	if err != nil {
+		panic(err)
+	}
+
+	m := y.IntoMapping()
+	if m.limits.MaxRemovals == nil || *m.limits.MaxRemovals != 5 ||
+		m.limits.MaxRemovalPercent == nil || *m.limits.MaxRemovalPercent != 12.5 {
+		panic(fmt.Sprintf("limits not parsed as expected: %+v", m.limits))
+	}
+}
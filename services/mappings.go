@@ -5,18 +5,26 @@ package services
 import (
 	"bytes"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/logger"
 	"github.com/logrusorgru/aurora"
 )
 
-//A Mapping is a single Mapping of source group(s) onto a target group.
+// A Mapping is a single Mapping of source group(s) onto a target group.
 type Mapping struct {
-	src   []GroupIdent
-	users []string
-	tar   GroupIdent
-	diff  *DiffResult
+	src     []GroupIdent
+	exprs   []SourceExpr
+	users   []string
+	tar     GroupIdent
+	limits  Limits
+	exclude []string
+	protect []string
+	diff    *DiffResult
 }
 
 func NewMapping(src []GroupIdent, tar GroupIdent) Mapping {
@@ -26,6 +34,24 @@ func NewMapping(src []GroupIdent, tar GroupIdent) Mapping {
 	}
 }
 
+// NewExprMapping creates a mapping whose sources may be set expressions, see
+// ParseSourceExpr. The members of all the sources are combined.
+func NewExprMapping(src []SourceExpr, tar GroupIdent) Mapping {
+	m := Mapping{
+		tar: tar,
+	}
+
+	for _, s := range src {
+		if group, ok := s.(GroupIdent); ok {
+			m.src = append(m.src, group)
+		} else {
+			m.exprs = append(m.exprs, s)
+		}
+	}
+
+	return m
+}
+
 // TODO: package the two []User values into a DiffResult object
 // Diff() should probably both return the DiffResult for inspection
 // AND store it inside the mapping for later use with commit changes!
@@ -48,24 +74,39 @@ func (m *Mapping) Diff() (DiffResult, error) {
 		}
 	}
 
-	targetSvc, err := TargetFromString(m.tar.svc)
+	_, err := TargetFromString(m.tar.svc)
 	if err != nil {
 		return DiffResult{}, err
 	}
 
-	for _, uid := range m.users {
-		user := newUser()
-		identity, err := targetSvc.identityFromUID(uid)
+	var warnings []string
+
+	// Set expressions are evaluated over the identities of users in the
+	// target service, the same as used for the diff.
+	for _, expr := range m.exprs {
+		users, exprWarnings, err := expr.evaluate(m.tar.svc)
+		if err != nil {
+			return DiffResult{}, err
+		}
+
+		for _, user := range users {
+			flattenedSrc = append(flattenedSrc, user)
+		}
+		warnings = append(warnings, exprWarnings...)
+	}
+
+	// Users are given as target user IDs or qualified with the service
+	// they're looked up in, e.g. `ldap:jdoe` or `email:jdoe@my-org.com`.
+	for _, ref := range m.users {
+		user, err := userFromRef(ref, m.tar.svc)
 		if err != nil {
-			logger.Errorf(
-				"Error finding user ID %v in %v. %v",
-				uid,
-				m.tar.svc,
+			warnings = append(warnings, fmt.Sprintf(
+				"couldn't find user `%s` - skipping: %v",
+				ref,
 				err,
-			)
+			))
 			continue
 		}
-		user.addIdentity(m.tar.svc, identity)
 
 		flattenedSrc = append(flattenedSrc, user)
 	}
@@ -76,37 +117,170 @@ func (m *Mapping) Diff() (DiffResult, error) {
 	}
 
 	diff, err := Diff(flattenedSrc, tarMembers, m.tar.svc)
-	// Yes, the equality is intended here! Only cache the DiffResult
-	// if there was no error calculating it.
-	if err == nil {
-		m.diff = &diff
+	if err != nil {
+		return DiffResult{}, err
 	}
+	diff.Warnings = append(warnings, diff.Warnings...)
 
-	return diff, err
+	err = m.applyExceptions(&diff)
+	if err != nil {
+		return DiffResult{}, err
+	}
+
+	// Only cache the DiffResult if there was no error calculating it.
+	m.diff = &diff
+
+	return diff, nil
 }
 
-func (m *Mapping) CommitChanges() error {
-	diff, err := m.Diff()
+// applyExceptions drops excluded users from the additions and protected users
+// from the removals of a diff.
+func (m *Mapping) applyExceptions(diff *DiffResult) error {
+	excluded, err := resolveRefs("exclude", m.exclude, m.tar.svc)
 	if err != nil {
 		return err
 	}
 
-	svc, err := TargetFromString(m.tar.svc)
+	protected, err := resolveRefs("protect", m.protect, m.tar.svc)
 	if err != nil {
 		return err
 	}
 
-	err = svc.AddMembers(m.tar.name, diff.Add)
+	var skipped []SkippedUser
+
+	diff.Add, skipped = skipUsers(diff.Add, excluded, m.tar.svc, "excluded")
+	diff.Skipped = append(diff.Skipped, skipped...)
+
+	diff.Rem, skipped = skipUsers(diff.Rem, protected, m.tar.svc, "protected")
+	diff.Skipped = append(diff.Skipped, skipped...)
+
+	return nil
+}
+
+// resolveRefs maps the target IDs of the users referenced in the `list`
+// exception list to the references. A reference that can't be resolved
+// fails the whole list, since skipping it could remove a protected user (or
+// add an excluded one). Users without an account in the target are left out,
+// as there's nothing to skip for them.
+func resolveRefs(list string, refs []string, tar string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	for _, ref := range refs {
+		user, err := userFromRef(ref, tar)
+		if err != nil {
+			return nil, newUnresolvedExceptionError(list, ref, tar, err)
+		}
+
+		id, err := user.getIdentity(tar)
+		if err != nil {
+			return nil, newUnresolvedExceptionError(list, ref, tar, err)
+		}
+
+		if IdentityExists(id) {
+			result[id.uniqueID()] = ref
+		}
+	}
+
+	return result, nil
+}
+
+// UnresolvedExceptionError is returned when a user in the `exclude` or
+// `protect` list of a mapping can't be looked up.
+type UnresolvedExceptionError struct {
+	list   string
+	ref    string
+	tar    string
+	source error
+}
+
+func newUnresolvedExceptionError(
+	list, ref, tar string,
+	source error,
+) UnresolvedExceptionError {
+	return UnresolvedExceptionError{
+		list:   list,
+		ref:    ref,
+		tar:    tar,
+		source: source,
+	}
+}
+
+func (e UnresolvedExceptionError) Error() string {
+	return fmt.Sprintf(
+		"cannot resolve `%s` from the %s list in %s: %v",
+		e.ref,
+		e.list,
+		e.tar,
+		e.source,
+	)
+}
+
+// skipUsers splits the users into those not matching any of the refs and
+// those that do.
+func skipUsers(
+	users []User,
+	refs map[string]string,
+	tar string,
+	reason string,
+) ([]User, []SkippedUser) {
+	var kept []User
+	var skipped []SkippedUser
+
+	for _, u := range users {
+		id, err := u.getIdentity(tar)
+		if err == nil {
+			ref, ok := refs[id.uniqueID()]
+			if ok {
+				skipped = append(skipped, SkippedUser{
+					User:   u,
+					Reason: fmt.Sprintf("%s as `%s`", reason, ref),
+				})
+				continue
+			}
+		}
+
+		kept = append(kept, u)
+	}
+
+	return kept, skipped
+}
+
+// CommitChanges commits the diff of the mapping to the target group. The
+// result of every change is returned, failed or not. An error is only
+// returned if the changes couldn't be committed at all.
+func (m *Mapping) CommitChanges() (CommitResult, error) {
+	diff, err := m.Diff()
 	if err != nil {
-		return err
+		return CommitResult{}, err
+	}
+
+	svc, err := TargetFromString(m.tar.svc)
+	if err != nil {
+		return CommitResult{}, err
 	}
 
-	err = svc.RemoveMembers(m.tar.name, diff.Rem)
+	// Mappings using the target as a source need to see the changes.
+	defer invalidateGroup(m.tar)
+
+	return commitChanges(svc, m.tar, diff.Add, diff.Rem)
+}
+
+// commitChanges adds users to and removes users from the `tar` group.
+func commitChanges(svc Target, tar GroupIdent, add, rem []User) (CommitResult, error) {
+	var result CommitResult
+	var err error
+
+	result.Added, err = svc.AddMembers(tar.name, add)
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	return nil
+	result.Removed, err = svc.RemoveMembers(tar.name, rem)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
 }
 
 func (m Mapping) String() string {
@@ -122,6 +296,9 @@ func (m Mapping) String() string {
 			),
 		)
 	}
+	for _, expr := range m.exprs {
+		b.WriteString(fmt.Sprintf("- %s\n", aurora.Cyan(expr)))
+	}
 
 	b.WriteString(m.tar.svc + " users:\n")
 	for _, user := range m.users {
@@ -156,6 +333,26 @@ func (m Mapping) String() string {
 				fmt.Sprintf("- %v\n", u.String()),
 			)
 		}
+
+		if len(m.diff.Warnings) > 0 {
+			b.WriteString("Warnings:\n")
+			for _, w := range m.diff.Warnings {
+				b.WriteString(fmt.Sprintf("- %s\n", aurora.Yellow(w)))
+			}
+		}
+
+		if len(m.diff.Skipped) > 0 {
+			b.WriteString("Skipped:\n")
+			for _, s := range m.diff.Skipped {
+				b.WriteString(
+					fmt.Sprintf(
+						"- %v(%s)\n",
+						s.User.String(),
+						aurora.Yellow(s.Reason),
+					),
+				)
+			}
+		}
 	}
 
 	return b.String()
@@ -167,17 +364,51 @@ type GroupIdent struct {
 	svc   string
 }
 
+// groupCache holds the members of the groups looked up during a run, keyed by
+// `service:group`, so that groups used by several mappings are only fetched
+// once. Groups are dropped from the cache when changes are committed to them.
+var groupCache = make(map[string][]User)
+var groupCacheMutex sync.Mutex
+
+// Members returns the members of the group, from the cache if they were
+// looked up before.
 func (i GroupIdent) Members() ([]User, error) {
-	if i.group == nil {
-		err := i.GetMembers()
-		if err != nil {
-			return nil, err
-		}
+	if i.group != nil {
+		return *i.group, nil
+	}
+
+	groupCacheMutex.Lock()
+	members, ok := groupCache[i.String()]
+	groupCacheMutex.Unlock()
+	if ok {
+		return members, nil
 	}
 
+	err := i.GetMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	groupCacheMutex.Lock()
+	groupCache[i.String()] = *i.group
+	groupCacheMutex.Unlock()
+
 	return *i.group, nil
 }
 
+// invalidateGroup drops the group from the cache, so that its members are
+// looked up again the next time they're needed.
+func invalidateGroup(i GroupIdent) {
+	groupCacheMutex.Lock()
+	defer groupCacheMutex.Unlock()
+
+	delete(groupCache, i.String())
+}
+
+func (i GroupIdent) String() string {
+	return fmt.Sprintf("%s:%s", i.svc, i.name)
+}
+
 func (i *GroupIdent) GetMembers() error {
 	svc, err := SvcFromString(i.svc)
 	if err != nil {
@@ -225,18 +456,150 @@ type YAMLMapping struct {
 	Sources []YAMLGroupIdent
 	Users   []string
 	Target  YAMLGroupIdent
+	Limits  `yaml:",inline"`
+
+	// A source with a GroupPattern, generating a mapping for every matching
+	// group - see IntoMappings. Can't be combined with Sources.
+	Source *YAMLGroupIdent
+
+	// Users never added to the target, even if in a source group.
+	Exclude []string
+	// Users never removed from the target, even if not in any source group.
+	Protect []string
 }
 
 // YAML
 type YAMLGroupIdent struct {
 	Service string
 	Group   string
+
+	// A set expression over groups, in place of Service and Group - see
+	// ParseSourceExpr. Only valid for sources.
+	Expr string
+
+	// A regular expression matching whole group names, in place of Group.
+	// Only valid for the `source` of a mapping.
+	GroupPattern string `yaml:"group_pattern"`
+}
+
+// IntoMappings turns the YAML mapping into mappings. A mapping with a pattern
+// `source` is expanded into a mapping for every group of the source service
+// matching the pattern, with `{{N}}` in the name of the target group replaced
+// with the Nth submatch, e.g.:
+//
+//	source: {service: ldap, group_pattern: "gh-(.*)"}
+//	target: {service: github, group: "{{1}}"}
+//
+// maps `ldap:gh-foo` onto `github:foo`, `ldap:gh-bar` onto `github:bar` etc.
+func (y YAMLMapping) IntoMappings() ([]Mapping, error) {
+	if y.Source == nil {
+		return []Mapping{y.IntoMapping()}, nil
+	}
+
+	if len(y.Sources) > 0 {
+		return nil, fmt.Errorf("a mapping can't have both `source` and `sources`")
+	}
+
+	// An empty pattern matches no groups, which is never what was meant.
+	if y.Source.GroupPattern == "" {
+		if y.Source.Group != "" {
+			return nil, fmt.Errorf(
+				"`source` needs a `group_pattern` - list the single group "+
+					"`%s` under `sources` instead",
+				y.Source.Group,
+			)
+		}
+
+		return nil, fmt.Errorf(
+			"`source` of service `%s` needs a `group_pattern`",
+			y.Source.Service,
+		)
+	}
+
+	pattern, err := regexp.Compile("^(?:" + y.Source.GroupPattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf(
+			"invalid group pattern `%s`: %v",
+			y.Source.GroupPattern,
+			err,
+		)
+	}
+
+	svc, err := SvcFromString(y.Source.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	lister, ok := svc.(GroupLister)
+	if !ok {
+		return nil, fmt.Errorf(
+			"service `%s` can't list its groups",
+			y.Source.Service,
+		)
+	}
+
+	groups, err := lister.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(groups)
+
+	var result []Mapping
+
+	for _, group := range groups {
+		match := pattern.FindStringSubmatch(group)
+		if match == nil {
+			continue
+		}
+
+		m := y
+		m.Source = nil
+		m.Sources = []YAMLGroupIdent{{Service: y.Source.Service, Group: group}}
+		m.Target.Group = expandGroupTemplate(y.Target.Group, match)
+
+		result = append(result, m.IntoMapping())
+	}
+
+	if len(result) == 0 {
+		logger.Warningf(
+			"No groups of `%s` match `%s`.",
+			y.Source.Service,
+			y.Source.GroupPattern,
+		)
+	}
+
+	return result, nil
+}
+
+var groupTemplateRef = regexp.MustCompile(`{{\s*(\d+)\s*}}`)
+
+// expandGroupTemplate replaces `{{N}}` in `template` with `match[N]`.
+func expandGroupTemplate(template string, match []string) string {
+	return groupTemplateRef.ReplaceAllStringFunc(template, func(ref string) string {
+		n, _ := strconv.Atoi(groupTemplateRef.FindStringSubmatch(ref)[1])
+		if n >= len(match) {
+			return ref
+		}
+
+		return match[n]
+	})
 }
 
 func (y YAMLMapping) IntoMapping() Mapping {
 	sources := make([]GroupIdent, 0)
+	var exprs []SourceExpr
 
 	for _, yamlSrc := range y.Sources {
+		if yamlSrc.Expr != "" {
+			expr, err := ParseSourceExpr(yamlSrc.Expr)
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			exprs = append(exprs, expr)
+			continue
+		}
+
 		src, err := yamlSrc.intoGroupIdent()
 		if err != nil {
 			logger.Fatal(err)
@@ -251,8 +614,12 @@ func (y YAMLMapping) IntoMapping() Mapping {
 	}
 
 	return Mapping{
-		src:   sources,
-		users: y.Users,
-		tar:   target,
+		src:     sources,
+		exprs:   exprs,
+		users:   y.Users,
+		tar:     target,
+		limits:  y.Limits,
+		exclude: y.Exclude,
+		protect: y.Protect,
 	}
 }
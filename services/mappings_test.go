@@ -0,0 +1,148 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMappingExceptions(t *testing.T) {
+	mockGroups["exceptions-src"] = buildMockUsers(0, 3)
+	mockGroups["exceptions-tar"] = buildMockUsers(1, 5)
+
+	mapping := NewMapping(
+		[]GroupIdent{{svc: "mockservice", name: "exceptions-src"}},
+		GroupIdent{svc: "mockservice", name: "exceptions-tar"},
+	)
+	mapping.exclude = []string{"0"}
+	mapping.protect = []string{"mockservice:4"}
+
+	diff, err := mapping.Diff()
+	if err != nil {
+		panic(err)
+	}
+
+	assertDiff(
+		[]User{mockGroups["exceptions-tar"][2]},
+		diff.Rem,
+		[]User{},
+		diff.Add,
+	)
+
+	if len(diff.Skipped) != 2 {
+		panic("expected one excluded and one protected user to be skipped")
+	}
+
+	// A protected user who can't be looked up might otherwise be removed.
+	var cases = []struct {
+		exclude []string
+		protect []string
+	}{
+		{[]string{"nope:jdoe"}, nil},
+		{nil, []string{"mockservice:4", "nope:jdoe"}},
+	}
+
+	for _, c := range cases {
+		unresolved := NewMapping(mapping.src, mapping.tar)
+		unresolved.exclude = c.exclude
+		unresolved.protect = c.protect
+
+		_, err = unresolved.Diff()
+		if _, ok := err.(UnresolvedExceptionError); !ok {
+			panic(fmt.Sprintf(
+				"expected an UnresolvedExceptionError, got %v",
+				err,
+			))
+		}
+	}
+}
+
+func TestMappingUserRefs(t *testing.T) {
+	mockGroups["refs-src"] = buildMockUsers(0, 1)
+	mockGroups["refs-tar"] = buildMockUsers(0, 1)
+
+	mapping := NewMapping(
+		[]GroupIdent{{svc: "mockservice", name: "refs-src"}},
+		GroupIdent{svc: "mockservice", name: "refs-tar"},
+	)
+	mapping.users = []string{
+		"1",
+		"mockservice:2",
+		// Mock users can't be found by email, nor in undefined services.
+		"email:jdoe@my-org.com",
+		"nope:jdoe",
+	}
+
+	diff, err := mapping.Diff()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(diff.Add) != 2 {
+		panic(fmt.Sprintf("expected 2 users to be added, got %v", diff.Add))
+	}
+
+	if len(diff.Warnings) != 2 {
+		panic(fmt.Sprintf("expected 2 warnings, got %v", diff.Warnings))
+	}
+}
+
+func TestPatternMappings(t *testing.T) {
+	mockGroups["pattern-gh-foo"] = buildMockUsers(0, 1)
+	mockGroups["pattern-gh-bar"] = buildMockUsers(0, 1)
+	mockGroups["pattern-other"] = buildMockUsers(0, 1)
+
+	var y YAMLMapping
+	err := yaml.Unmarshal([]byte(`
+source:
+  service: mockservice
+  group_pattern: pattern-gh-(.*)
+target:
+  service: github
+  group: team-{{1}}
+max_removals: 5
+`), &y)
+	if err != nil {
+		panic(err)
+	}
+
+	mappings, err := y.IntoMappings()
+	if err != nil {
+		panic(err)
+	}
+
+	var actual []string
+	for _, m := range mappings {
+		actual = append(actual, fmt.Sprintf("%s -> %s", m.src[0], m.tar))
+
+		if m.limits.MaxRemovals == nil || *m.limits.MaxRemovals != 5 {
+			panic("generated mappings should keep the limits")
+		}
+	}
+
+	expected := "[mockservice:pattern-gh-bar -> github:team-bar " +
+		"mockservice:pattern-gh-foo -> github:team-foo]"
+	if fmt.Sprint(actual) != expected {
+		panic(fmt.Sprintf("unexpected mappings generated: %v", actual))
+	}
+
+	y.Sources = []YAMLGroupIdent{{Service: "mockservice", Group: "pattern-other"}}
+	_, err = y.IntoMappings()
+	if err == nil {
+		panic("expected an error for a mapping with both source and sources")
+	}
+
+	// A source without a pattern would silently generate no mappings.
+	y.Sources = nil
+	for _, source := range []YAMLGroupIdent{
+		{Service: "mockservice"},
+		{Service: "mockservice", Group: "pattern-other"},
+	} {
+		y.Source = &source
+		_, err = y.IntoMappings()
+		if err == nil {
+			panic(fmt.Sprintf("expected an error for source %+v", source))
+		}
+	}
+}
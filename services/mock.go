@@ -1,11 +1,18 @@
 package services
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 // used for testing the service cache to verify the service gets initialized
 // only once
 var svcInitCount uint
 
+// mockGroups holds the in-memory groups of MockService, keyed by group name.
+var mockGroups = make(map[string][]User)
+var mockGroupsMutex sync.Mutex
+
 type MockService struct {
 }
 
@@ -14,16 +21,95 @@ func newMockService() MockService {
 	return MockService{}
 }
 
-func (t MockService) AddMembers(users []User) error {
-	return nil
+func (t MockService) AddMembers(group string, users []User) ([]ChangeResult, error) {
+	mockGroupsMutex.Lock()
+	defer mockGroupsMutex.Unlock()
+
+	var results []ChangeResult
+	for _, u := range users {
+		// Users without a mock identity can't be members of mock groups.
+		_, err := u.getIdentity("mockservice")
+		if err != nil {
+			results = append(results, changeFailed(u, err))
+			continue
+		}
+
+		mockGroups[group] = append(mockGroups[group], u)
+		results = append(results, changeCommitted(u))
+	}
+
+	return results, nil
 }
 
-func (t MockService) RemoveMembers(users []User) error {
-	return nil
+func (t MockService) RemoveMembers(group string, users []User) ([]ChangeResult, error) {
+	var results []ChangeResult
+
+	rem := make(map[string]bool)
+	for _, u := range users {
+		i, err := u.getIdentity("mockservice")
+		if err != nil {
+			results = append(results, changeFailed(u, err))
+			continue
+		}
+		rem[i.uniqueID()] = true
+		results = append(results, changeCommitted(u))
+	}
+
+	mockGroupsMutex.Lock()
+	defer mockGroupsMutex.Unlock()
+
+	var kept []User
+	for _, u := range mockGroups[group] {
+		i, err := u.getIdentity("mockservice")
+		if err != nil {
+			return nil, err
+		}
+		if !rem[i.uniqueID()] {
+			kept = append(kept, u)
+		}
+	}
+	mockGroups[group] = kept
+
+	return results, nil
 }
 
 func (t MockService) GroupMembers(group string) ([]User, error) {
-	return nil, fmt.Errorf("unimplemented")
+	mockGroupsMutex.Lock()
+	defer mockGroupsMutex.Unlock()
+
+	members, ok := mockGroups[group]
+	if !ok {
+		return nil, fmt.Errorf("mock group `%s` not defined", group)
+	}
+
+	return append([]User(nil), members...), nil
+}
+
+func (t MockService) ListGroups() ([]string, error) {
+	mockGroupsMutex.Lock()
+	defer mockGroupsMutex.Unlock()
+
+	var groups []string
+	for name := range mockGroups {
+		groups = append(groups, name)
+	}
+
+	return groups, nil
+}
+
+func (t MockService) acquireIdentity(user *User) (Identity, error) {
+	return nil, fmt.Errorf(
+		"couldn't acquire mock identity for user:\n%v",
+		user,
+	)
+}
+
+func (t MockService) identityFromUID(uid string) (Identity, error) {
+	return MockIdentity{uid: uid}, nil
+}
+
+func (t MockService) identityFor(uid string) Identity {
+	return MockIdentity{uid: uid}
 }
 
 type MockIdentity struct {
@@ -41,6 +127,10 @@ func (i MockIdentity) uniqueID() string {
 	return i.uid
 }
 
+func (i MockIdentity) userID() string {
+	return i.uid
+}
+
 func (i MockIdentity) String() string {
 	return fmt.Sprintf("mockidentity{uid: %s}", i.uniqueID())
 }
@@ -0,0 +1,244 @@
+package services
+
+// Ordering mappings so that groups are synced before they're used as sources.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// sources returns all the source groups of the mapping.
+func (m *Mapping) sources() []GroupIdent {
+	result := append([]GroupIdent(nil), m.src...)
+	for _, expr := range m.exprs {
+		result = append(result, expr.groups()...)
+	}
+
+	return result
+}
+
+// OrderMappings sorts mappings so that a mapping whose target is a source of
+// other mappings comes before them, e.g. `ldap:platform` → `github:platform`
+// before `github:platform` → `github:all-eng`. Mappings that don't depend
+// on each other keep their order. Cycles are rejected with a
+// MappingCycleError.
+func OrderMappings(mappings []Mapping) ([]Mapping, error) {
+	deps := mappingDependencies(mappings)
+	done := make([]bool, len(mappings))
+	var result []Mapping
+
+	for len(result) < len(mappings) {
+		next := -1
+
+		// Pick the first mapping whose dependencies are all done, so
+		// that the original order is kept where possible.
+		for i := range mappings {
+			if !done[i] && allDone(deps[i], done) {
+				next = i
+				break
+			}
+		}
+
+		if next < 0 {
+			return nil, newMappingCycleError(findCycle(mappings, deps, done))
+		}
+
+		done[next] = true
+		result = append(result, mappings[next])
+	}
+
+	return result, nil
+}
+
+// mappingDependencies returns, for every mapping, the indices of the
+// mappings whose target it reads.
+func mappingDependencies(mappings []Mapping) [][]int {
+	byTarget := make(map[string][]int)
+	for i := range mappings {
+		tar := mappings[i].tar.String()
+		byTarget[tar] = append(byTarget[tar], i)
+	}
+
+	deps := make([][]int, len(mappings))
+	for i := range mappings {
+		for _, src := range mappings[i].sources() {
+			deps[i] = append(deps[i], byTarget[src.String()]...)
+		}
+	}
+
+	return deps
+}
+
+// RunMappings calls `run` for every mapping, running up to `parallelism`
+// mappings at once. A mapping is only started once the earlier mappings it
+// depends on, as well as the earlier mappings to the same target, are done -
+// so `mappings` should be ordered with OrderMappings first. With a
+// parallelism of 1, mappings are run one by one, in order.
+//
+// If `run` fails for a mapping, the mappings depending on it (directly or
+// not) aren't run, and `skip` is called for them instead.
+func RunMappings(
+	mappings []Mapping,
+	parallelism int,
+	run func(i int, m *Mapping) error,
+	skip func(i int, m *Mapping, err DependencyFailedError),
+) {
+	deps := mappingDependencies(mappings)
+	errs := make([]error, len(mappings))
+
+	// process runs (or skips) a mapping once the mappings it waits for are
+	// done.
+	process := func(i int) {
+		for _, j := range deps[i] {
+			if j < i && errs[j] != nil {
+				err := newDependencyFailedError(mappings[j].tar, errs[j])
+				errs[i] = err
+				skip(i, &mappings[i], err)
+				return
+			}
+		}
+
+		errs[i] = run(i, &mappings[i])
+	}
+
+	if parallelism <= 1 {
+		for i := range mappings {
+			process(i)
+		}
+		return
+	}
+
+	// Mappings to the same target don't depend on each other, but they
+	// shouldn't change it at the same time either.
+	waitFor := make([][]int, len(mappings))
+	for i := range mappings {
+		waitFor[i] = append(waitFor[i], deps[i]...)
+		for j := 0; j < i; j++ {
+			if mappings[j].tar.String() == mappings[i].tar.String() {
+				waitFor[i] = append(waitFor[i], j)
+			}
+		}
+	}
+
+	done := make([]chan struct{}, len(mappings))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i := range mappings {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+
+			// Only wait for earlier mappings, like a sequential run
+			// would, so that unordered mappings can't deadlock.
+			for _, j := range waitFor[i] {
+				if j < i {
+					<-done[j]
+				}
+			}
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			process(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func allDone(indices []int, done []bool) bool {
+	for _, i := range indices {
+		if !done[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// findCycle returns the targets of a cycle of mappings among the ones not
+// done yet, starting and ending with the same group.
+func findCycle(mappings []Mapping, deps [][]int, done []bool) []string {
+	// Every mapping not done has a dependency that's not done either, so
+	// following dependencies from any of them has to lead into a cycle.
+	var path []int
+	onPath := make(map[int]int)
+
+	i := 0
+	for done[i] {
+		i++
+	}
+
+	for {
+		if start, ok := onPath[i]; ok {
+			var cycle []string
+			for _, j := range path[start:] {
+				cycle = append(cycle, mappings[j].tar.String())
+			}
+
+			return append(cycle, mappings[i].tar.String())
+		}
+
+		onPath[i] = len(path)
+		path = append(path, i)
+
+		for _, j := range deps[i] {
+			if !done[j] {
+				i = j
+				break
+			}
+		}
+	}
+}
+
+// DependencyFailedError is passed for mappings that weren't run by
+// RunMappings, because a mapping whose target they read failed.
+type DependencyFailedError struct {
+	dependency GroupIdent
+	source     error
+}
+
+func newDependencyFailedError(
+	dependency GroupIdent,
+	source error,
+) DependencyFailedError {
+	return DependencyFailedError{
+		dependency: dependency,
+		source:     source,
+	}
+}
+
+func (e DependencyFailedError) Error() string {
+	return fmt.Sprintf(
+		"the mapping to `%s` it depends on failed: %v",
+		e.dependency,
+		e.source,
+	)
+}
+
+// MappingCycleError is returned when mappings depend on each other in a
+// cycle, e.g. `github:a` is synced from `github:b` and the other way round.
+type MappingCycleError struct {
+	groups []string
+}
+
+func newMappingCycleError(groups []string) MappingCycleError {
+	return MappingCycleError{
+		groups: groups,
+	}
+}
+
+func (e MappingCycleError) Error() string {
+	return fmt.Sprintf(
+		"mappings form a cycle (each group is synced from the next): %s",
+		strings.Join(e.groups, " <- "),
+	)
+}
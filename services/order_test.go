@@ -0,0 +1,211 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestOrderMappings(t *testing.T) {
+	mappings := []Mapping{
+		testMapping("github:all-eng", "github:platform", "github:infra"),
+		testMapping("github:platform", "ldap:platform"),
+		testMapping("gitlab:eng", "ldap:eng"),
+		testMapping("github:infra", "ldap:infra"),
+	}
+
+	ordered, err := OrderMappings(mappings)
+	if err != nil {
+		panic(err)
+	}
+
+	var targets []string
+	for _, m := range ordered {
+		targets = append(targets, m.tar.String())
+	}
+
+	expected := "[github:platform gitlab:eng github:infra github:all-eng]"
+	if fmt.Sprint(targets) != expected {
+		panic(fmt.Sprintf("unexpected order of mappings: %v", targets))
+	}
+
+	mappings = append(
+		mappings,
+		testMapping("github:platform", "github:all-eng"),
+	)
+
+	_, err = OrderMappings(mappings)
+	if _, ok := err.(MappingCycleError); !ok {
+		panic(fmt.Sprintf("expected a MappingCycleError, got %v", err))
+	}
+
+	const cycle = "github:all-eng <- github:platform <- github:all-eng"
+	if err.Error() != "mappings form a cycle (each group is synced from "+
+		"the next): "+cycle {
+		panic("the cycle isn't reported as expected: " + err.Error())
+	}
+}
+
+func TestCommitInvalidatesGroupCache(t *testing.T) {
+	// Members cached by earlier runs of the test (e.g. with -count) would
+	// hide the groups set up below.
+	groupCacheMutex.Lock()
+	groupCache = make(map[string][]User)
+	groupCacheMutex.Unlock()
+
+	mockGroups["invalidate-src"] = buildMockUsers(0, 3)
+	mockGroups["invalidate-mid"] = buildMockUsers(0, 1)
+	mockGroups["invalidate-tar"] = buildMockUsers(0, 1)
+
+	first := testMapping("mockservice:invalidate-mid", "mockservice:invalidate-src")
+	second := testMapping("mockservice:invalidate-tar", "mockservice:invalidate-mid")
+
+	// Look up the intermediate group before it's synced.
+	_, err := second.sources()[0].Members()
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = first.CommitChanges()
+	if err != nil {
+		panic(err)
+	}
+
+	diff, err := second.Diff()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(diff.Add) != 2 {
+		panic(fmt.Sprintf("stale members of invalidate-mid used: %v", diff.Add))
+	}
+}
+
+func TestRunMappings(t *testing.T) {
+	mockGroups["par-src"] = buildMockUsers(0, 3)
+	mockGroups["par-a"] = nil
+	mockGroups["par-b"] = nil
+
+	mappings := []Mapping{
+		testMapping("mockservice:par-a", "mockservice:par-src"),
+		testMapping("mockservice:par-b", "mockservice:par-a"),
+	}
+	for i := 0; i < 8; i++ {
+		tar := fmt.Sprintf("par-%d", i)
+		mockGroups[tar] = buildMockUsers(2, 5)
+		mappings = append(
+			mappings,
+			testMapping("mockservice:"+tar, "mockservice:par-src"),
+		)
+	}
+
+	ran := make([]bool, len(mappings))
+
+	RunMappings(
+		mappings,
+		4,
+		func(i int, m *Mapping) error {
+			_, err := m.Diff()
+			if err != nil {
+				panic(fmt.Sprintf("%v: %v", m.tar, err))
+			}
+
+			_, err = m.CommitChanges()
+			if err != nil {
+				panic(err)
+			}
+
+			ran[i] = true
+			return nil
+		},
+		func(i int, m *Mapping, err DependencyFailedError) {
+			panic(fmt.Sprintf("%v skipped: %v", m.tar, err))
+		},
+	)
+
+	for i, ok := range ran {
+		if !ok {
+			panic(fmt.Sprintf("mapping %d wasn't run", i))
+		}
+	}
+
+	// par-b can only be synced from par-a once par-a is.
+	for _, group := range []string{"par-a", "par-b", "par-5"} {
+		members, err := MockService{}.GroupMembers(group)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(members) != 3 {
+			panic(fmt.Sprintf("unexpected members of %s: %v", group, members))
+		}
+	}
+}
+
+func TestRunMappingsWithFailures(t *testing.T) {
+	mappings := []Mapping{
+		testMapping("mockservice:fail-a", "mockservice:fail-src"),
+		testMapping("mockservice:fail-b", "mockservice:fail-a"),
+		testMapping("mockservice:fail-c", "mockservice:fail-b"),
+		testMapping("mockservice:fail-d", "mockservice:fail-src2"),
+	}
+
+	for _, parallelism := range []int{1, 4} {
+		var mutex sync.Mutex
+		var ran, skipped []string
+
+		RunMappings(
+			mappings,
+			parallelism,
+			func(i int, m *Mapping) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				ran = append(ran, m.tar.name)
+				if m.tar.name == "fail-a" {
+					return fmt.Errorf("no such group")
+				}
+				return nil
+			},
+			func(i int, m *Mapping, err DependencyFailedError) {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				skipped = append(skipped, m.tar.name)
+			},
+		)
+
+		sort.Strings(ran)
+		sort.Strings(skipped)
+
+		if fmt.Sprint(ran) != "[fail-a fail-d]" ||
+			fmt.Sprint(skipped) != "[fail-b fail-c]" {
+			panic(fmt.Sprintf(
+				"parallelism %d: ran %v, skipped %v",
+				parallelism,
+				ran,
+				skipped,
+			))
+		}
+	}
+}
+
+func testMapping(tar string, src ...string) Mapping {
+	var sources []GroupIdent
+	for _, s := range src {
+		ident, err := ParseGroupIdent(s)
+		if err != nil {
+			panic(err)
+		}
+
+		sources = append(sources, ident)
+	}
+
+	target, err := ParseGroupIdent(tar)
+	if err != nil {
+		panic(err)
+	}
+
+	return NewMapping(sources, target)
+}
@@ -0,0 +1,295 @@
+package services
+
+// Tools for recording the changes computed for mappings and committing them
+// at a later point.
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+)
+
+// PlanVersion is the version of the plan format produced by NewPlan.
+const PlanVersion = 1
+
+// Plan is a reviewable record of the changes to be committed for a set of
+// mappings.
+type Plan struct {
+	Version  int           `json:"version"`
+	Created  time.Time     `json:"created"`
+	Mappings []MappingPlan `json:"mappings"`
+}
+
+// MappingPlan is the recorded DiffResult of a single Mapping.
+type MappingPlan struct {
+	Sources    []string      `json:"sources"`
+	Users      []string      `json:"users,omitempty"`
+	Target     string        `json:"target"`
+	SourceHash string        `json:"source_hash"`
+	TargetHash string        `json:"target_hash"`
+	Add        []PlannedUser `json:"add"`
+	Rem        []PlannedUser `json:"remove"`
+	Warnings   []string      `json:"warnings,omitempty"`
+}
+
+// PlannedUser identifies a user to be added to or removed from a target
+// group.
+type PlannedUser struct {
+	// The unique ID of the user in the target service.
+	ID string `json:"id"`
+	// The user ID the target service can look the user up by.
+	UID string `json:"uid"`
+	// All the identities of the user known at planning time.
+	Info string `json:"info"`
+}
+
+// NewPlan calculates the diff of every mapping and records it.
+func NewPlan(mappings []Mapping) (Plan, error) {
+	plan := Plan{
+		Version: PlanVersion,
+		Created: time.Now().UTC(),
+	}
+
+	for i := range mappings {
+		mp, err := mappings[i].Plan()
+		if err != nil {
+			return Plan{}, err
+		}
+
+		plan.Mappings = append(plan.Mappings, mp)
+	}
+
+	return plan, nil
+}
+
+// Plan calculates the diff of the mapping and records it.
+func (m *Mapping) Plan() (MappingPlan, error) {
+	diff, err := m.Diff()
+	if err != nil {
+		return MappingPlan{}, err
+	}
+
+	result := MappingPlan{
+		Users:      m.users,
+		Target:     m.tar.String(),
+		SourceHash: diff.SourceHash,
+		TargetHash: diff.TargetHash,
+		Warnings:   diff.Warnings,
+	}
+
+	for _, src := range m.src {
+		result.Sources = append(result.Sources, src.String())
+	}
+	for _, expr := range m.exprs {
+		result.Sources = append(result.Sources, expr.String())
+	}
+
+	result.Add, err = planUsers(diff.Add, m.tar.svc)
+	if err != nil {
+		return MappingPlan{}, err
+	}
+
+	result.Rem, err = planUsers(diff.Rem, m.tar.svc)
+	if err != nil {
+		return MappingPlan{}, err
+	}
+
+	return result, nil
+}
+
+func planUsers(users []User, tar string) ([]PlannedUser, error) {
+	result := make([]PlannedUser, 0, len(users))
+
+	for _, u := range users {
+		i, err := u.getIdentity(tar)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, PlannedUser{
+			ID:   i.uniqueID(),
+			UID:  i.userID(),
+			Info: u.String(),
+		})
+	}
+
+	return result, nil
+}
+
+// Apply commits the changes recorded in the plan. All the target groups are
+// checked for drift first - if the membership of any of them has changed since
+// the plan was made, nothing is committed. The results of the changes are
+// returned per mapping, in the order of the plan.
+func (p Plan) Apply() ([]CommitResult, error) {
+	if p.Version != PlanVersion {
+		return nil, fmt.Errorf(
+			"unsupported plan version %d (expected %d)",
+			p.Version,
+			PlanVersion,
+		)
+	}
+
+	var prepared []preparedPlan
+
+	for _, mp := range p.Mappings {
+		pp, err := mp.prepare()
+		if err != nil {
+			return nil, err
+		}
+
+		prepared = append(prepared, pp)
+	}
+
+	var results []CommitResult
+
+	for _, pp := range prepared {
+		result, err := pp.commit()
+		results = append(results, result)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// preparedPlan is a MappingPlan that was checked against the current state of
+// the target and is ready to be committed.
+type preparedPlan struct {
+	tar GroupIdent
+	svc Target
+	add []User
+	rem []User
+}
+
+func (p MappingPlan) prepare() (preparedPlan, error) {
+	tar, err := ParseGroupIdent(p.Target)
+	if err != nil {
+		return preparedPlan{}, err
+	}
+
+	svc, err := TargetFromString(tar.svc)
+	if err != nil {
+		return preparedPlan{}, err
+	}
+
+	// Always look at the current state of the target, not a cached one.
+	err = tar.GetMembers()
+	if err != nil {
+		return preparedPlan{}, err
+	}
+
+	current := make(map[string]User)
+	for _, u := range *tar.group {
+		i, err := u.getIdentity(tar.svc)
+		if err == nil && IdentityExists(i) {
+			current[i.uniqueID()] = u
+		}
+	}
+
+	if snapshotHash(current) != p.TargetHash {
+		return preparedPlan{}, newPlanDriftError(p.Target)
+	}
+
+	result := preparedPlan{
+		tar: tar,
+		svc: svc,
+	}
+
+	for _, pu := range p.Rem {
+		u, ok := current[pu.ID]
+		if !ok {
+			return preparedPlan{}, newPlanDriftError(p.Target)
+		}
+
+		result.rem = append(result.rem, u)
+	}
+
+	for _, pu := range p.Add {
+		i, err := svc.identityFromUID(pu.UID)
+		if err != nil {
+			return preparedPlan{}, err
+		}
+
+		if i.uniqueID() != pu.ID {
+			return preparedPlan{}, fmt.Errorf(
+				"user `%s` in %s no longer has the planned ID %s",
+				pu.UID,
+				tar.svc,
+				pu.ID,
+			)
+		}
+
+		u := newUser()
+		u.addIdentity(tar.svc, i)
+		result.add = append(result.add, u)
+	}
+
+	return result, nil
+}
+
+func (p preparedPlan) commit() (CommitResult, error) {
+	defer invalidateGroup(p.tar)
+
+	return commitChanges(p.svc, p.tar, p.add, p.rem)
+}
+
+func (p MappingPlan) String() string {
+	var b bytes.Buffer
+
+	b.WriteString("Sources:\n")
+	for _, src := range p.Sources {
+		b.WriteString(fmt.Sprintf("- %s\n", aurora.Cyan(src)))
+	}
+
+	if len(p.Users) > 0 {
+		b.WriteString("Users:\n")
+		for _, user := range p.Users {
+			b.WriteString(fmt.Sprintf("- %s\n", aurora.Cyan(user)))
+		}
+	}
+
+	b.WriteString("Target:\n")
+	b.WriteString(fmt.Sprintf("- %s\n", aurora.Blue(p.Target)))
+
+	b.WriteString("Rem:\n")
+	for _, u := range p.Rem {
+		b.WriteString(fmt.Sprintf("- %s\n", u.Info))
+	}
+
+	b.WriteString("Add:\n")
+	for _, u := range p.Add {
+		b.WriteString(fmt.Sprintf("- %s\n", u.Info))
+	}
+
+	if len(p.Warnings) > 0 {
+		b.WriteString("Warnings:\n")
+		for _, w := range p.Warnings {
+			b.WriteString(fmt.Sprintf("- %s\n", aurora.Yellow(w)))
+		}
+	}
+
+	return b.String()
+}
+
+// PlanDriftError is returned when the membership of a target group changed
+// since the plan was made.
+type PlanDriftError struct {
+	target string
+}
+
+func newPlanDriftError(target string) PlanDriftError {
+	return PlanDriftError{
+		target: target,
+	}
+}
+
+func (e PlanDriftError) Error() string {
+	return fmt.Sprintf(
+		"membership of `%s` has changed since the plan was made; "+
+			"refusing to apply it",
+		e.target,
+	)
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestPlanApply(t *testing.T) {
+	mockGroups["plan-src"] = buildMockUsers(0, 3)
+	mockGroups["plan-tar"] = buildMockUsers(1, 4)
+
+	plan := newMockPlan("plan-src", "plan-tar")
+
+	if len(plan.Mappings[0].Add) != 1 || len(plan.Mappings[0].Rem) != 1 {
+		panic(fmt.Sprintf("unexpected plan: %+v", plan.Mappings[0]))
+	}
+
+	results, err := plan.Apply()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(results) != 1 || results[0].Err() != nil {
+		panic(fmt.Sprintf("unexpected results of the plan: %+v", results))
+	}
+
+	assertMockGroup("plan-tar", []string{"0", "1", "2"})
+}
+
+func TestPlanApplyWithDrift(t *testing.T) {
+	mockGroups["drift-src"] = buildMockUsers(0, 3)
+	mockGroups["drift-tar"] = buildMockUsers(1, 4)
+
+	plan := newMockPlan("drift-src", "drift-tar")
+
+	// Someone else changes the target after the plan was reviewed.
+	mockGroups["drift-tar"] = append(
+		mockGroups["drift-tar"],
+		buildMockUsers(7, 8)...,
+	)
+
+	_, err := plan.Apply()
+	switch err.(type) {
+	case PlanDriftError:
+	default:
+		panic(fmt.Sprintf("Apply() should return a PlanDriftError, got %v", err))
+	}
+
+	assertMockGroup("drift-tar", []string{"1", "2", "3", "7"})
+}
+
+// Helpers
+
+// newMockPlan builds a plan for a single mock mapping and passes it through
+// JSON, like it would be when stored in a file.
+func newMockPlan(src, tar string) Plan {
+	mapping := NewMapping(
+		[]GroupIdent{{svc: "mockservice", name: src}},
+		GroupIdent{svc: "mockservice", name: tar},
+	)
+
+	plan, err := NewPlan([]Mapping{mapping})
+	if err != nil {
+		panic(err)
+	}
+
+	data, err := json.Marshal(plan)
+	if err != nil {
+		panic(err)
+	}
+
+	var result Plan
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		panic(err)
+	}
+
+	return result
+}
+
+func assertMockGroup(group string, expected []string) {
+	actual := make(map[string]bool)
+	for _, u := range mockGroups[group] {
+		actual[u.identities["mockservice"].uniqueID()] = true
+	}
+
+	if len(actual) != len(expected) {
+		panic(fmt.Sprintf(
+			"mock group %s: expected %v, got %v",
+			group,
+			expected,
+			actual,
+		))
+	}
+
+	for _, id := range expected {
+		if !actual[id] {
+			panic(fmt.Sprintf(
+				"mock group %s: expected %v, got %v",
+				group,
+				expected,
+				actual,
+			))
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package services
+
+// Structured reports of group memberships and sync results, for consumption
+// by other tools.
+
+import "sort"
+
+// ReportVersion is the version of the report format. It's bumped whenever
+// fields are renamed or removed, or their meaning changes.
+const ReportVersion = 1
+
+// GroupsReport lists the members of groups, see NewGroupReport.
+type GroupsReport struct {
+	Version int           `json:"version" yaml:"version"`
+	Groups  []GroupReport `json:"groups" yaml:"groups"`
+}
+
+// GroupReport lists the members of a single group.
+type GroupReport struct {
+	Service string         `json:"service" yaml:"service"`
+	Group   string         `json:"group" yaml:"group"`
+	Members []MemberReport `json:"members" yaml:"members"`
+	// Why the members couldn't be looked up, if they couldn't.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// MemberReport lists all the known identities of a user, keyed by service
+// name.
+type MemberReport struct {
+	Identities map[string]IdentityReport `json:"identities" yaml:"identities"`
+}
+
+// IdentityReport is the identity of a user in a service.
+type IdentityReport struct {
+	// The unique ID of the user, e.g. the LDAP user ID or the GitHub node ID.
+	ID string `json:"id" yaml:"id"`
+	// The user ID the service can look the user up by, e.g. the GitHub login.
+	UID string `json:"uid" yaml:"uid"`
+}
+
+// SyncReport lists the results of syncing mappings.
+type SyncReport struct {
+	Version  int             `json:"version" yaml:"version"`
+	Mappings []MappingReport `json:"mappings" yaml:"mappings"`
+}
+
+// MappingStatus is the outcome of syncing a mapping.
+type MappingStatus string
+
+const (
+	// The changes were committed.
+	MappingCommitted MappingStatus = "committed"
+	// The changes weren't committed, as it was a dry run.
+	MappingDryRun MappingStatus = "dry_run"
+	// The changes went over the safety limits and weren't committed.
+	MappingSkipped MappingStatus = "skipped"
+	// Committing the changes failed.
+	MappingFailed MappingStatus = "failed"
+)
+
+// MappingReport is the diff of a single mapping and the outcome of syncing
+// it.
+type MappingReport struct {
+	Sources  []string       `json:"sources" yaml:"sources"`
+	Users    []string       `json:"users,omitempty" yaml:"users,omitempty"`
+	Target   string         `json:"target" yaml:"target"`
+	Add      []MemberReport `json:"add" yaml:"add"`
+	Remove   []MemberReport `json:"remove" yaml:"remove"`
+	Skipped  []SkipReport   `json:"skipped" yaml:"skipped"`
+	Warnings []string       `json:"warnings" yaml:"warnings"`
+	Status   MappingStatus  `json:"status" yaml:"status"`
+	// The changes that failed to be committed.
+	Failed []FailureReport `json:"failed" yaml:"failed"`
+	// Why the mapping was skipped or failed.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// FailureReport is a change that failed to be committed.
+type FailureReport struct {
+	Member MemberReport `json:"member" yaml:"member"`
+	// Either `add` or `remove`.
+	Change string `json:"change" yaml:"change"`
+	Error  string `json:"error" yaml:"error"`
+}
+
+// SkipReport is a user left out of the changes by a mapping exception.
+type SkipReport struct {
+	Member MemberReport `json:"member" yaml:"member"`
+	Reason string       `json:"reason" yaml:"reason"`
+}
+
+// NewGroupReport reports the members of group `group` of service `svc`.
+func NewGroupReport(svc, group string, members []User) GroupReport {
+	return GroupReport{
+		Service: svc,
+		Group:   group,
+		Members: memberReports(members),
+	}
+}
+
+// Report reports the diff of the mapping, which has to be calculated first.
+// The status is left for the caller to fill in.
+func (m *Mapping) Report() MappingReport {
+	result := MappingReport{
+		Users:    m.users,
+		Target:   m.tar.String(),
+		Add:      []MemberReport{},
+		Remove:   []MemberReport{},
+		Skipped:  []SkipReport{},
+		Warnings: []string{},
+		Failed:   []FailureReport{},
+	}
+
+	for _, src := range m.src {
+		result.Sources = append(result.Sources, src.String())
+	}
+	for _, expr := range m.exprs {
+		result.Sources = append(result.Sources, expr.String())
+	}
+
+	if m.diff == nil {
+		return result
+	}
+
+	result.Add = memberReports(m.diff.Add)
+	result.Remove = memberReports(m.diff.Rem)
+	result.Warnings = append(result.Warnings, m.diff.Warnings...)
+
+	for _, s := range m.diff.Skipped {
+		result.Skipped = append(result.Skipped, SkipReport{
+			Member: newMemberReport(s.User),
+			Reason: s.Reason,
+		})
+	}
+
+	return result
+}
+
+// SetCommitResult reports the changes of `result` that failed.
+func (r *MappingReport) SetCommitResult(result CommitResult) {
+	r.Failed = []FailureReport{}
+
+	add := func(change string, results []ChangeResult) {
+		for _, c := range results {
+			if c.Err != nil {
+				r.Failed = append(r.Failed, FailureReport{
+					Member: newMemberReport(c.User),
+					Change: change,
+					Error:  c.Err.Error(),
+				})
+			}
+		}
+	}
+
+	add("add", result.Added)
+	add("remove", result.Removed)
+}
+
+func memberReports(users []User) []MemberReport {
+	result := make([]MemberReport, 0, len(users))
+	for _, u := range users {
+		result = append(result, newMemberReport(u))
+	}
+
+	// Keep reports stable between runs.
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].key() < result[j].key()
+	})
+
+	return result
+}
+
+func newMemberReport(u User) MemberReport {
+	identitiesMutex.RLock()
+	defer identitiesMutex.RUnlock()
+
+	result := MemberReport{
+		Identities: make(map[string]IdentityReport),
+	}
+
+	for svc, id := range u.identities {
+		if !IdentityExists(id) {
+			continue
+		}
+
+		result.Identities[svc] = IdentityReport{
+			ID:  id.uniqueID(),
+			UID: id.userID(),
+		}
+	}
+
+	return result
+}
+
+// key orders member reports by the identities they're made of.
+func (r MemberReport) key() string {
+	svcs := make([]string, 0, len(r.Identities))
+	for svc := range r.Identities {
+		svcs = append(svcs, svc)
+	}
+	sort.Strings(svcs)
+
+	var key string
+	for _, svc := range svcs {
+		key += svc + ":" + r.Identities[svc].ID + "\n"
+	}
+
+	return key
+}
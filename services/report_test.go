@@ -0,0 +1,52 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestMappingReport(t *testing.T) {
+	mockGroups["report-src"] = buildMockUsers(0, 3)
+	mockGroups["report-tar"] = buildMockUsers(2, 4)
+
+	m := testMapping("mockservice:report-tar", "mockservice:report-src")
+
+	_, err := m.Diff()
+	if err != nil {
+		panic(err)
+	}
+
+	report := m.Report()
+	report.Status = MappingDryRun
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		panic(err)
+	}
+
+	const expected = `{"sources":["mockservice:report-src"],` +
+		`"target":"mockservice:report-tar",` +
+		`"add":[` +
+		`{"identities":{"mockservice":{"id":"0","uid":"0"}}},` +
+		`{"identities":{"mockservice":{"id":"1","uid":"1"}}}],` +
+		`"remove":[{"identities":{"mockservice":{"id":"3","uid":"3"}}}],` +
+		`"skipped":[],"warnings":[],"status":"dry_run","failed":[]}`
+
+	if string(data) != expected {
+		panic(fmt.Sprintf("unexpected report:\n%s", data))
+	}
+}
+
+func TestGroupReport(t *testing.T) {
+	members := buildMockUsers(0, 1)
+	members[0].addIdentity("ldap", NoneIdentity{})
+	members[0].addIdentity("github", GitHubIdentity{ID: "MDQ6", Login: "jdoe"})
+
+	report := NewGroupReport("mockservice", "group", members)
+
+	ids := report.Members[0].Identities
+	if len(ids) != 2 || ids["github"].UID != "jdoe" || ids["github"].ID != "MDQ6" {
+		panic(fmt.Sprintf("unexpected identities reported: %v", ids))
+	}
+}
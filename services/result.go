@@ -0,0 +1,96 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ChangeResult is the outcome of adding a single user to (or removing them
+// from) a target group.
+type ChangeResult struct {
+	User User
+	// Why the change failed, or nil if it was committed.
+	Err error
+}
+
+// CommitResult is the outcome of committing the changes of a mapping, user
+// by user.
+type CommitResult struct {
+	Added   []ChangeResult
+	Removed []ChangeResult
+}
+
+// Failed returns the number of changes that failed.
+func (r CommitResult) Failed() int {
+	failed := 0
+	for _, c := range append(r.Added, r.Removed...) {
+		if c.Err != nil {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// Err returns a CommitFailedError if any of the changes failed, or nil.
+func (r CommitResult) Err() error {
+	failed := r.Failed()
+	if failed == 0 {
+		return nil
+	}
+
+	return newCommitFailedError(failed, len(r.Added)+len(r.Removed))
+}
+
+func (r CommitResult) String() string {
+	var b bytes.Buffer
+
+	write := func(change string, results []ChangeResult) {
+		for _, c := range results {
+			if c.Err != nil {
+				b.WriteString(fmt.Sprintf(
+					"- %s %v: %v\n",
+					change,
+					c.User.String(),
+					c.Err,
+				))
+			}
+		}
+	}
+
+	if r.Failed() > 0 {
+		b.WriteString("Failed:\n")
+		write("add", r.Added)
+		write("remove", r.Removed)
+	}
+
+	return b.String()
+}
+
+// changeFailed is the ChangeResult of a user that couldn't be changed.
+func changeFailed(user User, err error) ChangeResult {
+	return ChangeResult{User: user, Err: err}
+}
+
+// changeCommitted is the ChangeResult of a user that was changed.
+func changeCommitted(user User) ChangeResult {
+	return ChangeResult{User: user}
+}
+
+// CommitFailedError is returned when some of the changes of a mapping (or
+// plan) couldn't be committed, see CommitResult for the details.
+type CommitFailedError struct {
+	failed int
+	total  int
+}
+
+func newCommitFailedError(failed, total int) CommitFailedError {
+	return CommitFailedError{
+		failed: failed,
+		total:  total,
+	}
+}
+
+func (e CommitFailedError) Error() string {
+	return fmt.Sprintf("%d of %d change(s) failed", e.failed, e.total)
+}
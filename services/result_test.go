@@ -0,0 +1,59 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCommitFailures(t *testing.T) {
+	mockGroups["failures-tar"] = buildMockUsers(0, 2)
+
+	stranger := newUser()
+	stranger.addIdentity("ldap", LDAPIdentity{id: "stranger"})
+
+	tar, err := ParseGroupIdent("mockservice:failures-tar")
+	if err != nil {
+		panic(err)
+	}
+
+	result, err := commitChanges(
+		MockService{},
+		tar,
+		append(buildMockUsers(5, 6), stranger),
+		buildMockUsers(0, 1),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(result.Added) != 2 || len(result.Removed) != 1 {
+		panic(fmt.Sprintf("expected a result per change, got %+v", result))
+	}
+
+	if result.Failed() != 1 || result.Added[1].Err == nil {
+		panic(fmt.Sprintf("adding the stranger should've failed: %+v", result))
+	}
+
+	err = result.Err()
+	if _, ok := err.(CommitFailedError); !ok {
+		panic(fmt.Sprintf("expected a CommitFailedError, got %v", err))
+	}
+	if err.Error() != "1 of 3 change(s) failed" {
+		panic("unexpected error: " + err.Error())
+	}
+
+	if !strings.Contains(result.String(), "- add ldap{uid: stranger}") {
+		panic("the failure isn't listed:\n" + result.String())
+	}
+
+	var report MappingReport
+	report.SetCommitResult(result)
+
+	if len(report.Failed) != 1 || report.Failed[0].Change != "add" ||
+		report.Failed[0].Member.Identities["ldap"].ID != "stranger" {
+		panic(fmt.Sprintf("unexpected failures reported: %+v", report.Failed))
+	}
+
+	assertMockGroup("failures-tar", []string{"1", "5"})
+}
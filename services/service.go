@@ -1,7 +1,12 @@
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/google/logger"
 )
@@ -13,7 +18,27 @@ type Service interface {
 	GroupMembers(group string) ([]User, error)
 }
 
+// GroupLister is implemented by services that can enumerate their groups,
+// e.g. to generate mappings from a pattern.
+type GroupLister interface {
+	// ListGroups returns the names of all the groups of the service, as
+	// accepted by GroupMembers.
+	ListGroups() ([]string, error)
+}
+
+// userResolver is implemented by services that can find a user by their ID.
+type userResolver interface {
+	identityFromUID(uid string) (Identity, error)
+}
+
+// identityBuilder is implemented by services whose identities can be built
+// from a user ID alone, without looking the user up.
+type identityBuilder interface {
+	identityFor(uid string) Identity
+}
+
 var initializedServices map[string]Service = make(map[string]Service)
+var initializedServicesMutex sync.Mutex
 
 // SvcFromString produces a Service object with config taken from the global
 // cfg variable.
@@ -31,33 +56,93 @@ func SvcFromString(name string) (Service, error) {
 		return nil, err
 	}
 
-	saveSvcInCache(name, svc)
-
-	return svc, nil
+	return saveSvcInCache(name, svc), nil
 }
 
-func saveSvcInCache(name string, svc Service) {
+// saveSvcInCache caches `svc` and returns it, unless another instance was
+// cached in the meantime (by a mapping running concurrently), in which case
+// that one is returned instead.
+func saveSvcInCache(name string, svc Service) Service {
+	initializedServicesMutex.Lock()
+	defer initializedServicesMutex.Unlock()
+
+	if cached, ok := initializedServices[name]; ok {
+		return cached
+	}
+
 	initializedServices[name] = svc
+	return svc
 }
 
 func lookUpServiceInCache(name string) (svc Service, ok bool) {
+	initializedServicesMutex.Lock()
+	defer initializedServicesMutex.Unlock()
+
 	svc, ok = initializedServices[name]
 	return
 }
 
+// closer is implemented by services holding on to connections that should be
+// closed once they're no longer needed.
+type closer interface {
+	close()
+}
+
+// CloseServices closes the connections of all the initialized services.
+func CloseServices() {
+	initializedServicesMutex.Lock()
+	defer initializedServicesMutex.Unlock()
+
+	for _, svc := range initializedServices {
+		if c, ok := svc.(closer); ok {
+			c.close()
+		}
+	}
+}
+
 func newSvcFromName(name string) (Service, error) {
 	cfg, err := getConfig()
 	if err != nil {
 		return nil, err
 	}
 
+	// Named instances take precedence over the top-level sections.
+	sc, ok := cfg.Services[name]
+	if ok {
+		return newSvcFromConfig(name, sc)
+	}
+
 	switch name {
 	case "ldap":
-		return NewLDAP(cfg.LDAP), nil
+		return NewLDAP(name, cfg.LDAP), nil
 	case "github":
-		return NewGitHub(cfg.GitHub), nil
+		return NewGitHub(name, cfg.GitHub), nil
+	case "gitlab":
+		return NewGitLab(name, cfg.GitLab), nil
+	case "file":
+		return NewFile(name, cfg.File), nil
 	case "mockservice":
 		return newMockService(), nil
+	}
+
+	// `<ldap service>-filter` runs LDAP filters against that service.
+	if base := strings.TrimSuffix(name, ldapFilterSuffix); base != name {
+		return newLDAPFilter(base)
+	}
+
+	return nil, newServiceNotDefined(name)
+}
+
+func newSvcFromConfig(name string, sc serviceConfig) (Service, error) {
+	switch sc.Type {
+	case "ldap":
+		return NewLDAP(name, sc.LDAP), nil
+	case "github":
+		return NewGitHub(name, sc.GitHub), nil
+	case "gitlab":
+		return NewGitLab(name, sc.GitLab), nil
+	case "file":
+		return NewFile(name, sc.File), nil
 	default:
 		return nil, newServiceNotDefined(name)
 	}
@@ -80,6 +165,21 @@ func (e ServiceNotDefined) Error() string {
 type DiffResult struct {
 	Rem []User
 	Add []User
+
+	// Users left out of Rem and Add because of mapping exceptions.
+	Skipped []SkippedUser
+
+	// Digests of the source and target memberships the diff was computed
+	// from, see snapshotHash.
+	SourceHash string
+	TargetHash string
+
+	// The number of members of the target group before any changes.
+	TargetSize int
+
+	// Problems that didn't stop the diff from being calculated, but that
+	// may make it incomplete, e.g. users that couldn't be looked up.
+	Warnings []string
 }
 
 func newDiffResult(rem, add []User) DiffResult {
@@ -94,6 +194,7 @@ func Diff(srcGrp, tarGrp []User, tar string) (DiffResult, error) {
 	// This approach also takes care of duplicates for free.
 	srcMap := make(map[string]User)
 	tarMap := make(map[string]User)
+	var warnings []string
 
 	if len(srcGrp) < 1 {
 		return DiffResult{}, newSourceGroupEmptyError()
@@ -106,12 +207,13 @@ func Diff(srcGrp, tarGrp []User, tar string) (DiffResult, error) {
 			case FatalError:
 				return DiffResult{}, e
 			default:
-				logger.Warningf(
-					"error acquiring identity for a user - skipping\n"+
-						"user: %v\nerror: %v\n",
+				warnings = append(warnings, fmt.Sprintf(
+					"couldn't acquire %s identity for source user %v- "+
+						"skipping: %v",
+					tar,
 					u,
 					e,
-				)
+				))
 			}
 
 		} else if IdentityExists(i) {
@@ -122,17 +224,22 @@ func Diff(srcGrp, tarGrp []User, tar string) (DiffResult, error) {
 	for _, u := range tarGrp {
 		i, e := u.getIdentity(tar)
 		if e != nil {
-			logger.Warningf(
-				"error acquiring identity for a user - skipping\n"+
-					"user: %v\nerror: %v\n",
+			warnings = append(warnings, fmt.Sprintf(
+				"couldn't acquire %s identity for target user %v- "+
+					"skipping: %v",
+				tar,
 				u,
 				e,
-			)
+			))
 		} else if IdentityExists(i) {
 			tarMap[i.uniqueID()] = u
 		}
 	}
 
+	srcHash := snapshotHash(srcMap)
+	tarHash := snapshotHash(tarMap)
+	tarSize := len(tarMap)
+
 	// Remove elements that exist in both the source and the target.
 	for id := range srcMap {
 		_, ok := tarMap[id]
@@ -155,7 +262,33 @@ func Diff(srcGrp, tarGrp []User, tar string) (DiffResult, error) {
 		rem = append(rem, identity)
 	}
 
-	return newDiffResult(rem, add), nil
+	result := newDiffResult(rem, add)
+	result.SourceHash = srcHash
+	result.TargetHash = tarHash
+	result.TargetSize = tarSize
+	result.Warnings = warnings
+
+	return result, nil
+}
+
+// SkippedUser is a user that would be added or removed if not for an
+// exception in the mapping.
+type SkippedUser struct {
+	User   User
+	Reason string
+}
+
+// snapshotHash produces a digest of a group membership keyed by unique IDs.
+// The result doesn't depend on the order the members were listed in.
+func snapshotHash(members map[string]User) string {
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return hex.EncodeToString(sum[:])
 }
 
 type SourceGroupEmptyError struct {
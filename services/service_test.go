@@ -8,6 +8,7 @@ import (
 
 func TestSvcCache(t *testing.T) {
 	svcInitCount = 0
+	delete(initializedServices, "mockservice")
 	var err error
 
 	_, err = SvcFromString("mockservice")
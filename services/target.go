@@ -4,8 +4,11 @@ import "fmt"
 
 // Target represents a service whose group memberships can be mutated.
 type Target interface {
-	AddMembers(team string, users []User) error
-	RemoveMembers(team string, users []User) error
+	// AddMembers and RemoveMembers return the result of the change of every
+	// user they got to. An error is only returned if the whole operation
+	// failed, e.g. if the group doesn't exist.
+	AddMembers(team string, users []User) ([]ChangeResult, error)
+	RemoveMembers(team string, users []User) ([]ChangeResult, error)
 	acquireIdentity(user *User) (Identity, error)
 	identityFromUID(uid string) (Identity, error)
 
@@ -22,6 +25,12 @@ func TargetFromString(name string) (Target, error) {
 	switch tar := svc.(type) {
 	case *GitHub:
 		return tar, nil
+	case *GitLab:
+		return tar, nil
+	case *LDAP:
+		return tar, nil
+	case MockService:
+		return tar, nil
 	default:
 		return nil, newTargetNotDefined(name)
 	}
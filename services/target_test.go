@@ -14,10 +14,20 @@ func TestWrongTargetName(t *testing.T) {
 	}
 }
 
+// sourceOnlyService is a Service that doesn't implement Target.
+type sourceOnlyService struct{}
+
+func (s sourceOnlyService) GroupMembers(group string) ([]User, error) {
+	return nil, nil
+}
+
 func TestServiceThatIsNotTarget(t *testing.T) {
 	var err error
 
-	_, err = TargetFromString("ldap")
+	saveSvcInCache("source-only", sourceOnlyService{})
+	defer delete(initializedServices, "source-only")
+
+	_, err = TargetFromString("source-only")
 	switch err.(type) {
 	case TargetNotDefined:
 		t.Log("TargetNotDefined thrown as it should be")
@@ -25,3 +35,14 @@ func TestServiceThatIsNotTarget(t *testing.T) {
 		panic("TargetFromString() doesn't throw TargetNotDefined")
 	}
 }
+
+func TestLDAPTarget(t *testing.T) {
+	tar, err := TargetFromString("ldap")
+	if err != nil {
+		panic(err)
+	}
+
+	if _, ok := tar.(*LDAP); !ok {
+		panic("LDAP should be usable as a target")
+	}
+}
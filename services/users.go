@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // User is used to identify users by their unique data acquired from
@@ -12,7 +15,15 @@ type User struct {
 	identities map[string]Identity
 }
 
+// identitiesMutex guards the identities of all users. Users are shared by
+// mappings running concurrently (see GroupIdent.Members), and identities are
+// added to them as they're acquired.
+var identitiesMutex sync.RWMutex
+
 func (u User) String() string {
+	identitiesMutex.RLock()
+	defer identitiesMutex.RUnlock()
+
 	buf := bytes.Buffer{}
 	for _, id := range u.identities {
 		buf.WriteString(fmt.Sprintf("%s ", id))
@@ -25,11 +36,26 @@ func newUser() User {
 }
 
 func (u *User) addIdentity(svc string, i Identity) {
+	identitiesMutex.Lock()
+	defer identitiesMutex.Unlock()
+
 	u.identities[svc] = i
 }
 
+// lookUpIdentity returns the identity of the user in `svc`, if it's known.
+func (u *User) lookUpIdentity(svc string) (Identity, bool) {
+	identitiesMutex.RLock()
+	defer identitiesMutex.RUnlock()
+
+	id, ok := u.identities[svc]
+	return id, ok
+}
+
 type Identity interface {
 	uniqueID() string
+	// userID returns the human-friendly user ID the identity can be looked up
+	// by again, see Target.identityFromUID.
+	userID() string
 	String() string
 }
 
@@ -39,10 +65,37 @@ func (_ NoneIdentity) uniqueID() string {
 	panic("identity doesn't exist")
 }
 
+func (_ NoneIdentity) userID() string {
+	panic("identity doesn't exist")
+}
+
 func (_ NoneIdentity) String() string {
 	return ""
 }
 
+// EmailIdentity identifies a user by nothing but their email. It's the
+// identity of users referenced as `email:<address>`, for targets to match
+// against their own users.
+type EmailIdentity struct {
+	email string
+}
+
+// The pseudo-service qualifying references to users by email.
+const emailService = "email"
+
+// Implement the Identity interface.
+func (i EmailIdentity) uniqueID() string {
+	return strings.ToLower(i.email)
+}
+
+func (i EmailIdentity) userID() string {
+	return i.email
+}
+
+func (i EmailIdentity) String() string {
+	return fmt.Sprintf("email{%s}", i.email)
+}
+
 func IdentityExists(i Identity) bool {
 	_, ok := i.(NoneIdentity)
 
@@ -57,9 +110,33 @@ func identityEqual(i1, i2 Identity) bool {
 	return i1.uniqueID() == i2.uniqueID()
 }
 
+// findIdentity returns the first identity (ordered by service name) that
+// satisfies `match`.
+func (u *User) findIdentity(match func(svc string, i Identity) bool) (Identity, bool) {
+	// Work on a copy, so that `match` is free to look up other identities.
+	identitiesMutex.RLock()
+	ids := make(map[string]Identity, len(u.identities))
+	var svcs []string
+	for svc, id := range u.identities {
+		ids[svc] = id
+		svcs = append(svcs, svc)
+	}
+	identitiesMutex.RUnlock()
+
+	sort.Strings(svcs)
+
+	for _, svc := range svcs {
+		if match(svc, ids[svc]) {
+			return ids[svc], true
+		}
+	}
+
+	return nil, false
+}
+
 func (u *User) getIdentity(svc_name string) (Identity, error) {
 	// Check if the identity is already stored in this instance of User
-	id, ok := u.identities[svc_name]
+	id, ok := u.lookUpIdentity(svc_name)
 	if ok {
 		return id, nil
 	}
@@ -76,6 +153,44 @@ func (u *User) getIdentity(svc_name string) (Identity, error) {
 	}
 
 	// Both store the identity and return it
-	u.identities[svc_name] = id
+	u.addIdentity(svc_name, id)
 	return id, nil
 }
+
+// userFromRef builds a User out of a reference to them. A reference is either
+// a user ID in the `svc` service, a user ID qualified with the name of the
+// service it belongs to, e.g. `ldap:jdoe`, or an email, e.g.
+// `email:jdoe@my-org.com`.
+func userFromRef(ref, svc string) (User, error) {
+	uid := ref
+	if split := strings.SplitN(ref, ":", 2); len(split) == 2 {
+		svc, uid = split[0], split[1]
+	}
+
+	if svc == emailService {
+		user := newUser()
+		user.addIdentity(emailService, EmailIdentity{email: uid})
+
+		return user, nil
+	}
+
+	s, err := SvcFromString(svc)
+	if err != nil {
+		return User{}, err
+	}
+
+	resolver, ok := s.(userResolver)
+	if !ok {
+		return User{}, fmt.Errorf("service `%s` can't look up users by ID", svc)
+	}
+
+	id, err := resolver.identityFromUID(uid)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := newUser()
+	user.addIdentity(svc, id)
+
+	return user, nil
+}